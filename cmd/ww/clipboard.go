@@ -0,0 +1,79 @@
+package main
+
+// There is no portable way to get at the clipboard from Go, so ww runs
+// whatever tool the platform has for it.
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardTool is a command that reads or writes the clipboard.
+type clipboardTool struct {
+	paste []string
+	copy  []string
+}
+
+// clipboardTools returns the tools that might reach the clipboard here, most
+// preferred first.
+func clipboardTools() []clipboardTool {
+	switch runtime.GOOS {
+	case "darwin":
+		return []clipboardTool{{paste: []string{"pbpaste"}, copy: []string{"pbcopy"}}}
+	case "windows":
+		return []clipboardTool{{
+			paste: []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"},
+			copy:  []string{"clip"},
+		}}
+	}
+	var tools []clipboardTool
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append(tools, clipboardTool{paste: []string{"wl-paste", "--no-newline"}, copy: []string{"wl-copy"}})
+	}
+	return append(tools,
+		clipboardTool{paste: []string{"xclip", "-selection", "clipboard", "-o"}, copy: []string{"xclip", "-selection", "clipboard"}},
+		clipboardTool{paste: []string{"xsel", "--clipboard", "--output"}, copy: []string{"xsel", "--clipboard", "--input"}},
+	)
+}
+
+// errNoClipboard is returned when none of the clipboard tools are installed.
+var errNoClipboard = errors.New("no clipboard tool found, install xclip, xsel or wl-clipboard")
+
+// clipboardCommand returns the first of the commands tools returns for it
+// that is installed.
+func clipboardCommand(args func(clipboardTool) []string) (*exec.Cmd, error) {
+	for _, t := range clipboardTools() {
+		if path, err := exec.LookPath(args(t)[0]); err == nil {
+			return exec.Command(path, args(t)[1:]...), nil
+		}
+	}
+	return nil, errNoClipboard
+}
+
+// readClipboard returns the text on the clipboard.
+func readClipboard() (string, error) {
+	cmd, err := clipboardCommand(func(t clipboardTool) []string { return t.paste })
+	if err != nil {
+		return "", err
+	}
+	cmd.Stderr = msgs
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// writeClipboard puts text on the clipboard.
+func writeClipboard(text string) error {
+	cmd, err := clipboardCommand(func(t clipboardTool) []string { return t.copy })
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = msgs
+	return cmd.Run()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"webwormhole.io/wormhole"
+)
+
+// What to do with incoming files whose names are taken.
+const (
+	policyOverwrite = "overwrite"
+	policyRename    = "rename"
+	policySkip      = "skip"
+	policyAsk       = "ask"
+)
+
+// existingPolicy returns the policy for the flags set, or an error if more
+// than one is.
+func existingPolicy(overwrite, rename, skip, ask bool) (string, error) {
+	policy := ""
+	for _, p := range []struct {
+		set  bool
+		name string
+	}{
+		{overwrite, policyOverwrite},
+		{rename, policyRename},
+		{skip, policySkip},
+		{ask, policyAsk},
+	} {
+		if !p.set {
+			continue
+		}
+		if policy != "" {
+			return "", fmt.Errorf("-%s and -%s are mutually exclusive", policy, p.name)
+		}
+		policy = p.name
+	}
+	if policy == "" {
+		policy = policyRename
+	}
+	return policy, nil
+}
+
+// resolveExisting returns the name to save a file the user already has a
+// file called name for, or "" if it should be skipped.
+func resolveExisting(out io.Writer, name, policy string) (string, error) {
+	if policy == policyAsk {
+		answer, err := prompt(out, fmt.Sprintf("%s already exists. overwrite, rename or skip? [o/r/S] ", name))
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(answer) {
+		case "o", "overwrite":
+			policy = policyOverwrite
+		case "r", "rename":
+			policy = policyRename
+		default:
+			policy = policySkip
+		}
+	}
+	switch policy {
+	case policyOverwrite:
+		return name, nil
+	case policyRename:
+		return freeName(name)
+	}
+	return "", nil
+}
+
+// freeName returns the first of "name (1).ext", "name (2).ext", etc. that
+// isn't taken.
+func freeName(name string) (string, error) {
+	dir, base := filepath.Split(name)
+	ext := filepath.Ext(base)
+	if ext == base {
+		// Dot files are all extension.
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+		_, err := os.Lstat(candidate)
+		if errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// skipFile reads and throws away a file the sender is sending.
+func skipFile(c *wormhole.Wormhole, h header) error {
+	if h.Resume {
+		if err := declineResume(c); err != nil {
+			return err
+		}
+	}
+	data, err := fileData(c, h, int64(h.Size))
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyBuffer(io.Discard, data, make([]byte, msgChunkSize))
+	if err != nil {
+		return err
+	}
+	if !h.Stream && n != int64(h.Size) {
+		return io.ErrUnexpectedEOF
+	}
+	if h.SHA256 {
+		var t trailer
+		return readJSON(c, &t)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+// With -json, ww reports what it is doing as a stream of JSON objects on
+// stderr, one per line, instead of messages meant for people. Every object
+// has an "event" field saying what kind of event it is.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"webwormhole.io/wormhole"
+)
+
+// codeEvent is emitted once a new wormhole has a code. Slot and URL are only
+// set if the code is for a slot on the signalling server.
+type codeEvent struct {
+	Event string `json:"event"`
+	Code  string `json:"code"`
+	Slot  string `json:"slot,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+// connectedEvent is emitted once the peers are connected.
+type connectedEvent struct {
+	Event           string `json:"event"`
+	Route           string `json:"route"`
+	LocalCandidate  string `json:"local_candidate,omitempty"`
+	RemoteCandidate string `json:"remote_candidate,omitempty"`
+	Fingerprint     string `json:"fingerprint"`
+}
+
+// fileEvent is emitted as a file, or data in a pipe, is transferred. Bytes
+// counts any part of it that was resumed. Size is -1 if it isn't known.
+type fileEvent struct {
+	Event  string `json:"event"`
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset,omitempty"`
+	Rate   int64  `json:"rate,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// errorEvent is emitted before ww exits because of an error. CloseCode is
+// the wormhole close code the error came with, if any.
+type errorEvent struct {
+	Event     string `json:"event"`
+	Error     string `json:"error"`
+	CloseCode int    `json:"close_code,omitempty"`
+}
+
+// Kinds of fileEvent.
+const (
+	eventFileStart    = "file_start"
+	eventFileProgress = "file_progress"
+	eventFileFinish   = "file_finish"
+	eventFileSkip     = "file_skip"
+)
+
+var emitMu sync.Mutex
+
+// emit writes v as an event, if -json is set.
+func emit(v interface{}) {
+	if !jsonOutput {
+		return
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	fmt.Fprintf(stderr, "%s\n", buf)
+}
+
+// emitFinish emits the event for a transfer that finished. sum is the
+// SHA-256 hash of the data transferred, if it was hashed.
+func emitFinish(name string, n, size int64, sum []byte) {
+	emit(fileEvent{
+		Event:  eventFileFinish,
+		Name:   name,
+		Bytes:  n,
+		Size:   size,
+		SHA256: hex.EncodeToString(sum),
+	})
+}
+
+// emitError emits the event for the error ww is about to exit with. The close
+// code is taken from the first error in v that has one.
+func emitError(msg string, v ...interface{}) {
+	e := errorEvent{Event: "error", Error: msg}
+	for _, arg := range v {
+		if err, ok := arg.(error); ok {
+			if e.CloseCode = closeCode(err); e.CloseCode != 0 {
+				break
+			}
+		}
+	}
+	emit(e)
+}
+
+// closeCode returns the wormhole close code for err, or 0 if there is none.
+func closeCode(err error) int {
+	var ce *wormhole.CloseError
+	switch {
+	case errors.As(err, &ce):
+		return ce.Code
+	case errors.Is(err, wormhole.ErrBadVersion):
+		return wormhole.CloseWrongProto
+	case errors.Is(err, wormhole.ErrBadKey):
+		return wormhole.CloseBadKey
+	case errors.Is(err, wormhole.ErrNoSuchSlot):
+		return wormhole.CloseNoSuchSlot
+	case errors.Is(err, wormhole.ErrTimedOut):
+		// Only returned when the WebRTC connection times out.
+		return wormhole.CloseWebRTCFailed
+	}
+	return 0
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"webwormhole.io/wormhole"
+)
+
+func TestCloseCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("no route to host"), 0},
+		{&wormhole.CloseError{Code: wormhole.CloseSlotTimedOut}, wormhole.CloseSlotTimedOut},
+		{fmt.Errorf("could not dial: %w", wormhole.ErrBadKey), wormhole.CloseBadKey},
+		{wormhole.ErrBadVersion, wormhole.CloseWrongProto},
+		{wormhole.ErrNoSuchSlot, wormhole.CloseNoSuchSlot},
+		{wormhole.ErrTimedOut, wormhole.CloseWebRTCFailed},
+	} {
+		if got := closeCode(c.err); got != c.want {
+			t.Errorf("closeCode(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
@@ -1,24 +1,120 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"unicode"
+
+	"webwormhole.io/compress"
+	"webwormhole.io/transfer"
+	"webwormhole.io/wormhole"
 )
 
 const (
 	// msgChunkSize is the maximum size of a WebRTC DataChannel message.
 	// 64k is okay for most modern browsers, 32 is conservative.
 	msgChunkSize = 32 << 10
+
+	// maxMsgSize is the largest control message we expect to read.
+	maxMsgSize = 64 << 10
+
+	// partSuffix is appended to the names of files while they are being
+	// received.
+	partSuffix = ".part"
+
+	// corruptSuffix is appended to the names of files that were received
+	// but failed their integrity check.
+	corruptSuffix = ".corrupt"
+)
+
+// header is the header of a file. See package transfer.
+type header = transfer.Header
+
+// dirType is the type of headers for directories. They have no data.
+const dirType = "inode/directory"
+
+// textType is the type of headers for text messages. The text is in the
+// header's name, and they have no data.
+const textType = "application/webwormhole-text"
+
+// Types of the messages of the resume extension.
+const (
+	offsetType = "application/webwormhole-offset"
+	startType  = "application/webwormhole-start"
 )
 
-type header struct {
-	Name string `json:"name",omitempty`
-	Size int    `json:"size",omitempty`
-	Type string `json:"type",omitempty`
+// resume is the receiver's answer to a header with Resume set, and the
+// sender's reply to that. The receiver sends the length of the prefix of
+// the file it already has and its SHA-256 hash. The sender checks the hash
+// and replies with the offset it will send the file from, which is either
+// the same offset or zero.
+type resume struct {
+	Type   string `json:"type"`
+	Offset int64  `json:"offset"`
+	Hash   []byte `json:"hash,omitempty"`
+}
+
+// trailerType is the type of trailers.
+const trailerType = "application/webwormhole-trailer"
+
+// trailer follows the data of files whose header has SHA256 set. The hash
+// is of the whole file, including any part of it that was resumed.
+type trailer struct {
+	Type   string `json:"type"`
+	SHA256 []byte `json:"sha256"`
+}
+
+// readMsg reads a control message.
+func readMsg(r io.Reader) ([]byte, error) {
+	buf := make([]byte, maxMsgSize)
+	n, err := r.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readJSON(r io.Reader, v interface{}) error {
+	msg, err := readMsg(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg, v)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// hashPrefix returns a SHA-256 hash that has been written the first n bytes
+// of r.
+func hashPrefix(r io.Reader, n int64) (hash.Hash, error) {
+	h := sha256.New()
+	written, err := io.Copy(h, io.LimitReader(r, n))
+	if err != nil {
+		return nil, err
+	}
+	if written != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return h, nil
 }
 
 func receive(args ...string) {
@@ -31,98 +127,739 @@ func receive(args ...string) {
 	}
 	length := set.Int("length", 2, "length of generated secret, if generating")
 	directory := set.String("dir", ".", "directory to put downloaded files")
+	maxSize := set.Int64("max-size", 0, "decline transfers of more than this many bytes, 0 for no limit")
+	yes := set.Bool("yes", false, "accept transfers without asking")
+	overwrite := set.Bool("overwrite", false, "overwrite existing files")
+	rename := set.Bool("rename", false, "save files with names that are taken as \"name (1).ext\" (default)")
+	skip := set.Bool("skip", false, "skip files with names that are taken")
+	askExisting := set.Bool("ask", false, "ask what to do with files with names that are taken")
+	toStdout := set.Bool("stdout", false, "write the contents of the files to stdout instead of saving them")
+	toClipboard := set.Bool("clipboard", false, "copy text messages to the clipboard instead of printing them to stdout")
 	set.Parse(args[1:])
 
 	if set.NArg() > 1 {
 		set.Usage()
 		os.Exit(2)
 	}
+	policy, err := existingPolicy(*overwrite, *rename, *skip, *askExisting)
+	if err != nil {
+		fmt.Fprintf(set.Output(), "%v\n", err)
+		os.Exit(2)
+	}
 	c := newConn(set.Arg(0), *length)
+	p := newProgress(c, msgs, isTerminal(os.Stderr))
+	if err := sendHello(c); err != nil {
+		logf("could not send hello: %v", err)
+	}
 
-	// TODO append number to existing filenames?
-
+	// Directories get their modes and times once everything in them has
+	// been written. Children come after their parents, so go backwards to
+	// not touch a directory after setting its time.
+	var dirs []header
+	// What the user agreed to receive, once the sender sends a manifest.
+	var allowed *allowance
+	setDirAttrs := func() {
+		for i := len(dirs) - 1; i >= 0; i-- {
+			setAttrs(dirs[i].Name, dirs[i])
+		}
+	}
 	for {
-		// First message is the header. 1k should be enough.
-		buf := make([]byte, 1<<10)
-		n, err := c.Read(buf)
+		msg, err := readMsg(c)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
+			// Everything up to here was received in full.
+			setDirAttrs()
 			fatalf("could not read file header: %v", err)
 		}
 		var h header
-		err = json.Unmarshal(buf[:n], &h)
+		if err := json.Unmarshal(msg, &h); err != nil {
+			fatalf("could not read file header: %v", err)
+		}
+
+		if h.Type == manifestType {
+			var m manifest
+			if err := json.Unmarshal(msg, &m); err != nil {
+				fatalf("could not read manifest: %v", err)
+			}
+			accept := decide(msgs, m, *maxSize, *yes)
+			if err := writeJSON(c, manifestReply{Type: replyType, Accept: accept}); err != nil {
+				fatalf("could not reply to manifest: %v", err)
+			}
+			if !accept {
+				fmt.Fprintf(msgs, "declined\n")
+				break
+			}
+			p.addTotal(m.Size)
+			allowed = newAllowance(m)
+			continue
+		}
+		if allowed != nil {
+			if err := allowed.take(h); err != nil {
+				fatalf("refusing to receive %q: %v", h.Name, err)
+			}
+		} else if h.Type != dirType {
+			// Senders without manifests get checked a file at a time.
+			if *maxSize > 0 && int64(h.Size) > *maxSize {
+				fatalf("refusing to receive %s: more than -max-size %s", h.Name, humanSize(*maxSize))
+			}
+			if !decideFile(msgs, h, *yes) {
+				fmt.Fprintf(msgs, "skipping %v: declined\n", h.Name)
+				emit(fileEvent{Event: eventFileSkip, Name: h.Name, Size: int64(h.Size)})
+				if h.Type != textType {
+					if err := skipFile(c, h); err != nil {
+						fatalf("could not skip file %s: %v", h.Name, err)
+					}
+				}
+				continue
+			}
+		}
+		if h.Type == textType {
+			if err := receiveText(h.Name, *toClipboard); err != nil {
+				fatalf("could not receive text: %v", err)
+			}
+			continue
+		}
+
+		if *toStdout {
+			if h.Type == dirType {
+				continue
+			}
+			if h.Resume {
+				if err := declineResume(c); err != nil {
+					fatalf("could not receive %s: %v", h.Name, err)
+				}
+			}
+			sum := sha256.New()
+			n, err := receiveData(c, p, io.MultiWriter(os.Stdout, sum), h, "receiving "+h.Name, 0, *maxSize)
+			if err != nil {
+				fatalf("\ncould not receive %s: %v", h.Name, err)
+			}
+			if h.SHA256 {
+				if err := checkTrailer(c, sum.Sum(nil)); err != nil {
+					fatalf("\n%s is corrupt: %v", h.Name, err)
+				}
+			}
+			emitFinish(h.Name, n, n, sum.Sum(nil))
+			continue
+		}
+
+		name, err := localPath(*directory, h.Name)
+		if err != nil {
+			fatalf("refusing to receive %q: %v", h.Name, err)
+		}
+		if h.Type == dirType {
+			if err := os.MkdirAll(name, 0777); err != nil {
+				fatalf("could not create directory %s: %v", h.Name, err)
+			}
+			h.Name = name
+			dirs = append(dirs, h)
+			continue
+		}
+		if _, err := os.Lstat(name); err == nil {
+			name, err = resolveExisting(msgs, name, policy)
+			if err != nil {
+				fatalf("could not decide what to do with existing file %s: %v", h.Name, err)
+			}
+			if name == "" {
+				fmt.Fprintf(msgs, "skipping %v: already exists\n", h.Name)
+				emit(fileEvent{Event: eventFileSkip, Name: h.Name, Size: int64(h.Size)})
+				p.skip(int64(h.Size))
+				if err := skipFile(c, h); err != nil {
+					fatalf("could not skip file %s: %v", h.Name, err)
+				}
+				continue
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			fatalf("could not create directory for %s: %v", h.Name, err)
+		}
+		n, sum, err := receiveFile(c, p, name, h, *maxSize)
 		if err != nil {
-			fatalf("could not decode file header: %v", err)
+			fatalf("\ncould not receive %s: %v", h.Name, err)
+		}
+		setAttrs(name, h)
+		emitFinish(h.Name, n, n, sum)
+	}
+	setDirAttrs()
+	c.Close()
+}
+
+// receiveFile receives the file the sender described in h and saves it as
+// name, by way of a partial file. It returns its size and SHA-256. If the
+// sender's trailer says it was received wrong, what was received is kept
+// in a file ending in corruptSuffix instead.
+func receiveFile(c *wormhole.Wormhole, p *progress, name string, h header, maxSize int64) (int64, []byte, error) {
+	f, offset, sum, err := openPart(c, name, h)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not create output file: %v", err)
+	}
+	label := fmt.Sprintf("receiving %v", h.Name)
+	if offset > 0 {
+		label = fmt.Sprintf("resuming %v from %v bytes", h.Name, offset)
+	}
+	n, err := receiveData(c, p, io.MultiWriter(f, sum), h, label, offset, maxSize)
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, nil, fmt.Errorf("could not save file: %v", err)
+	}
+	if h.SHA256 {
+		if err := checkTrailer(c, sum.Sum(nil)); err != nil {
+			corrupt := name + corruptSuffix
+			if e := os.Rename(f.Name(), corrupt); e != nil {
+				corrupt = f.Name()
+			}
+			return 0, nil, fmt.Errorf("file is corrupt: %v; kept what was received in %s", err, corrupt)
+		}
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return 0, nil, fmt.Errorf("could not save file: %v", err)
+	}
+	return n, sum.Sum(nil), nil
+}
+
+// receiveText prints a text message to stdout, or copies it to the clipboard.
+// On a terminal, control characters are left out, so that the peer cannot
+// send escape sequences to it.
+func receiveText(text string, toClipboard bool) error {
+	if !toClipboard {
+		if isTerminal(os.Stdout) {
+			text = stripControl(text)
+		}
+		if !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		_, err := io.WriteString(os.Stdout, text)
+		return err
+	}
+	if err := writeClipboard(text); err != nil {
+		return err
+	}
+	fmt.Fprintf(msgs, "copied text to the clipboard\n")
+	return nil
+}
+
+// stripControl removes the control characters from text, other than
+// newlines and tabs.
+func stripControl(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// receiveData copies the data of the file with header h, from offset on, to w
+// as the sender sends it, and returns the size of the file. Streams longer
+// than maxSize are refused, unless it is zero. Other files are checked
+// against it before they are received.
+func receiveData(c *wormhole.Wormhole, p *progress, w io.Writer, h header, label string, offset, maxSize int64) (int64, error) {
+	size := int64(h.Size)
+	if h.Stream {
+		size = -1
+	}
+	data, err := fileData(c, h, size-offset)
+	if err != nil {
+		return 0, err
+	}
+	if h.Stream && maxSize > 0 {
+		data = io.LimitReader(data, maxSize+1)
+	}
+	written, err := p.copy(w, data, h.Name, label, size, offset)
+	if err != nil {
+		return 0, err
+	}
+	if h.Stream {
+		if maxSize > 0 && written > maxSize {
+			return 0, fmt.Errorf("more than -max-size %s", humanSize(maxSize))
+		}
+		fmt.Fprintf(msgs, "%s... done\n", label)
+		return written, nil
+	}
+	if offset+written != size {
+		return 0, fmt.Errorf("EOF before receiving all bytes: (%d/%d)", offset+written, size)
+	}
+	return size, nil
+}
+
+// fileData returns a reader of the n bytes of a file's data the sender is
+// about to send, decompressing them if h says they are compressed. Streams
+// are read up to their end marker instead.
+func fileData(c *wormhole.Wormhole, h header, n int64) (io.Reader, error) {
+	var r io.Reader = c
+	if h.Stream {
+		r, n = &frameReader{r: c}, math.MaxInt64
+	}
+	if h.Compression == "" {
+		return io.LimitReader(r, n), nil
+	}
+	cr, err := compress.NewReader(r, h.Compression, n)
+	if err != nil {
+		return nil, fmt.Errorf("%v %q", err, h.Compression)
+	}
+	return cr, nil
+}
+
+// localPath returns where to put the file the peer called name, under root.
+// Names are slash-separated paths relative to root. It rejects names that
+// would put the file anywhere else: absolute paths, paths with .. elements,
+// and paths through symbolic links.
+func localPath(root, name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(local) || filepath.VolumeName(local) != "" {
+		return "", errors.New("not a relative path")
+	}
+	p := root
+	exists := true
+	for _, elem := range strings.Split(name, "/") {
+		switch {
+		case elem == "" || elem == ".":
+			continue
+		case elem == "..":
+			return "", errors.New("path contains ..")
+		case strings.ContainsRune(elem, filepath.Separator):
+			return "", errors.New("not a relative path")
+		}
+		p = filepath.Join(p, elem)
+		if !exists {
+			continue
+		}
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			exists = false
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symbolic link", p)
+		}
+	}
+	if p == root {
+		return "", errors.New("empty path")
+	}
+	return p, nil
+}
+
+// setAttrs sets the permissions and modification time of name to those in
+// h, if it has them.
+func setAttrs(name string, h header) {
+	if mode := h.FileMode(); mode != 0 {
+		if err := os.Chmod(name, mode); err != nil {
+			logf("could not set mode of %s: %v", name, err)
 		}
+	}
+	if t := h.ModTime(); !t.IsZero() {
+		if err := os.Chtimes(name, t, t); err != nil {
+			logf("could not set modification time of %s: %v", name, err)
+		}
+	}
+}
+
+// checkTrailer reads the trailer of a file and checks the file's hash was
+// sum.
+func checkTrailer(c *wormhole.Wormhole, sum []byte) error {
+	var t trailer
+	if err := readJSON(c, &t); err != nil {
+		return fmt.Errorf("could not read trailer: %v", err)
+	}
+	if t.Type != trailerType {
+		return fmt.Errorf("unexpected message %q instead of trailer", t.Type)
+	}
+	if !bytes.Equal(t.SHA256, sum) {
+		return fmt.Errorf("SHA-256 is %x, sender says it should be %x", sum, t.SHA256)
+	}
+	return nil
+}
+
+// declineResume tells a sender that wants to resume a file that we have none
+// of it.
+func declineResume(c *wormhole.Wormhole) error {
+	if err := writeJSON(c, resume{Type: offsetType}); err != nil {
+		return err
+	}
+	var start resume
+	if err := readJSON(c, &start); err != nil {
+		return err
+	}
+	if start.Type != startType || start.Offset != 0 {
+		return fmt.Errorf("sender wants to start at unexpected offset %d", start.Offset)
+	}
+	return nil
+}
 
-		f, err := os.Create(filepath.Join(*directory, filepath.Clean("/"+h.Name)))
+// openPart opens the partial file for name, positioned where the data the
+// sender is about to send goes. If the sender can resume, it agrees on the
+// offset to continue from with it. It also returns a hash of the part of
+// the file before that. A partial file that is a symbolic link is refused,
+// so that a peer cannot have it write somewhere else.
+func openPart(c *wormhole.Wormhole, name string, h header) (f *os.File, offset int64, sum hash.Hash, err error) {
+	if info, err := os.Lstat(name + partSuffix); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return nil, 0, nil, fmt.Errorf("%s is a symbolic link", name+partSuffix)
+	}
+	f, err = os.OpenFile(name+partSuffix, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer func() {
 		if err != nil {
-			fatalf("could not create output file %s: %v", h.Name, err)
+			f.Close()
 		}
-		fmt.Fprintf(set.Output(), "receiving %v... ", h.Name)
-		written, err := io.CopyBuffer(f, io.LimitReader(c, int64(h.Size)), make([]byte, msgChunkSize))
+	}()
+	// The partial file could have been swapped for a link between the
+	// check above and opening it, so check it is still what was opened.
+	opened, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if info, err := os.Lstat(name + partSuffix); err != nil || !os.SameFile(info, opened) {
+		return nil, 0, nil, fmt.Errorf("%s changed while opening it", name+partSuffix)
+	}
+
+	sum = sha256.New()
+	if h.Resume {
+		info, err := f.Stat()
 		if err != nil {
-			fatalf("\ncould not save file: %v", err)
+			return nil, 0, nil, err
 		}
-		if written != int64(h.Size) {
-			fatalf("\nEOF before receiving all bytes: (%d/%d)", written, h.Size)
+		have := resume{Type: offsetType}
+		prefix := sha256.New()
+		if info.Size() <= int64(h.Size) {
+			have.Offset = info.Size()
+			prefix, err = hashPrefix(f, have.Offset)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+		}
+		have.Hash = prefix.Sum(nil)
+		if err := writeJSON(c, have); err != nil {
+			return nil, 0, nil, err
+		}
+		var start resume
+		if err := readJSON(c, &start); err != nil {
+			return nil, 0, nil, err
+		}
+		if start.Type != startType || start.Offset != 0 && start.Offset != have.Offset {
+			return nil, 0, nil, fmt.Errorf("sender wants to start at unexpected offset %d", start.Offset)
+		}
+		offset = start.Offset
+		if offset > 0 {
+			sum = prefix
 		}
-		f.Close()
-		fmt.Fprintf(set.Output(), "done\n")
 	}
-	c.Close()
+
+	if err := f.Truncate(offset); err != nil {
+		return nil, 0, nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, 0, nil, err
+	}
+	return f, offset, sum, nil
 }
 
 func send(args ...string) {
 	set := flag.NewFlagSet(args[0], flag.ExitOnError)
 	set.Usage = func() {
-		fmt.Fprintf(set.Output(), "send files\n\n")
+		fmt.Fprintf(set.Output(), "send files and directories, or stdin if the file is -, or text\n\n")
 		fmt.Fprintf(set.Output(), "usage: %s %s [files]...\n\n", os.Args[0], args[0])
 		fmt.Fprintf(set.Output(), "flags:\n")
 		set.PrintDefaults()
 	}
 	length := set.Int("length", 2, "length of generated secret")
 	code := set.String("code", "", "use a wormhole code instead of generating one")
+	name := set.String("name", "stdin", "name to send stdin as")
+	text := set.String("text", "", "send this text message")
+	clipboard := set.Bool("clipboard", false, "send the text on the clipboard")
 	set.Parse(args[1:])
 
-	if set.NArg() < 1 {
+	if set.NArg() < 1 && *text == "" && !*clipboard {
 		set.Usage()
 		os.Exit(2)
 	}
+	var items []item
+	if *text != "" {
+		items = append(items, textItem(*text))
+	}
+	if *clipboard {
+		t, err := readClipboard()
+		if err != nil {
+			fatalf("could not read clipboard: %v", err)
+		}
+		if t == "" {
+			fatalf("the clipboard has no text")
+		}
+		items = append(items, textItem(t))
+	}
+	items = append(items, collect(msgs, set.Args(), *name)...)
 	c := newConn(*code, *length)
+	supported := readHello(c)
+	p := newProgress(c, msgs, isTerminal(os.Stderr))
+	for _, it := range items {
+		p.addTotal(int64(it.h.Size))
+	}
 
-	for _, filename := range set.Args() {
-		f, err := os.Open(filename)
+	for _, it := range items {
+		if it.h.Type == dirType && !supported[featureDirs] {
+			fatalf("cannot send directory %s: the receiver does not support directories", it.path)
+		}
+		if it.h.Stream && !supported[featureStream] {
+			fatalf("cannot send stdin: the receiver does not support streams")
+		}
+		if it.h.Type == textType && !supported[featureText] {
+			fatalf("cannot send text: the receiver does not support text messages")
+		}
+	}
+	if supported[featureManifest] {
+		fmt.Fprintf(msgs, "waiting for the other side to accept... ")
+		accepted, err := offer(c, items)
 		if err != nil {
-			fatalf("could not open file %s: %v", filename, err)
+			fatalf("\ncould not send manifest: %v", err)
 		}
-		info, err := f.Stat()
+		if !accepted {
+			fatalf("\nthe other side declined")
+		}
+		fmt.Fprintf(msgs, "accepted\n")
+	}
+	for _, it := range items {
+		if it.h.Type == dirType {
+			if err := writeJSON(c, it.h); err != nil {
+				fatalf("could not send directory header: %v", err)
+			}
+			continue
+		}
+		if it.h.Type == textType {
+			if err := writeJSON(c, it.h); err != nil {
+				fatalf("could not send text: %v", err)
+			}
+			fmt.Fprintf(msgs, "sent text\n")
+			continue
+		}
+		sendFile(c, p, it, supported)
+	}
+	c.Close()
+}
+
+// item is a file or directory to send.
+type item struct {
+	path string
+	h    header
+}
+
+// collect lists the files to send for the paths given as arguments.
+// Directories are listed with everything in them, named relative to their
+// parents. A path of - is stdin, sent as a stream called stdinName.
+func collect(out io.Writer, paths []string, stdinName string) []item {
+	var items []item
+	stdin := false
+	for _, filename := range paths {
+		if filename == "-" {
+			if stdin {
+				fatalf("cannot send stdin more than once")
+			}
+			stdin = true
+			items = append(items, item{path: filename, h: header{Version: transfer.Version, Name: stdinName, Stream: true}})
+			continue
+		}
+		info, err := os.Stat(filename)
 		if err != nil {
 			fatalf("could not stat file %s: %v", filename, err)
 		}
-		h, err := json.Marshal(header{
-			Name: filepath.Base(filepath.Clean(filename)),
-			Size: int(info.Size()),
+		if !info.IsDir() {
+			items = append(items, newItem(filename, filepath.Base(filepath.Clean(filename)), info))
+			continue
+		}
+
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			fatalf("could not open directory %s: %v", filename, err)
+		}
+		// Send the contents of / without a top level directory.
+		base := filepath.Base(abs)
+		if base == string(filepath.Separator) {
+			base = ""
+		}
+		err = filepath.WalkDir(filename, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(filename, p)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(rel))
+			if name == "." {
+				return nil
+			}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				fmt.Fprintf(out, "skipping %v: not a regular file\n", p)
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			items = append(items, newItem(p, name, info))
+			return nil
 		})
 		if err != nil {
-			fatalf("failed to marshal json: %v", err)
+			fatalf("could not read directory %s: %v", filename, err)
 		}
-		_, err = c.Write(h)
+	}
+	return items
+}
+
+// textItem returns the item for a text message. It fails if text doesn't fit
+// in a message.
+func textItem(text string) item {
+	h := header{Version: transfer.Version, Name: text, Type: textType}
+	buf, err := json.Marshal(h)
+	if err != nil {
+		fatalf("could not encode text: %v", err)
+	}
+	if len(buf) > maxMsgSize {
+		fatalf("text is too long to send as a message, send it as a file instead")
+	}
+	return item{h: h}
+}
+
+func newItem(filename, name string, info fs.FileInfo) item {
+	h := header{
+		Version: transfer.Version,
+		Name:    name,
+		Mode:    uint32(info.Mode().Perm()),
+	}
+	h.SetModTime(info.ModTime())
+	if info.IsDir() {
+		h.Type = dirType
+	} else {
+		h.Size = int(info.Size())
+	}
+	return item{path: filename, h: h}
+}
+
+// sendFile sends the file it.
+func sendFile(c *wormhole.Wormhole, p *progress, it item, supported map[string]bool) {
+	f := os.Stdin
+	var err error
+	if !it.h.Stream {
+		f, err = os.Open(it.path)
 		if err != nil {
-			fatalf("could not send file header: %v", err)
+			fatalf("could not open file %s: %v", it.path, err)
+		}
+		defer f.Close()
+	}
+	h := it.h
+	h.Resume = supported[featureResume] && !h.Stream
+	h.SHA256 = supported[featureSHA256]
+	if h.Type == "" {
+		// Streams can't be sniffed without waiting for their data, so
+		// they go by their names.
+		var head []byte
+		if !h.Stream {
+			head = make([]byte, transfer.SniffLen)
+			n, err := f.ReadAt(head, 0)
+			if err != nil && err != io.EOF {
+				fatalf("could not read file %s: %v", it.path, err)
+			}
+			head = head[:n]
 		}
-		fmt.Fprintf(set.Output(), "sending %v... ", filepath.Base(filepath.Clean(filename)))
-		written, err := io.CopyBuffer(c, f, make([]byte, msgChunkSize))
+		h.Type = transfer.DetectType(h.Name, head)
+	}
+	if compress.Compressible(h.Type) {
+		for _, scheme := range compress.Schemes {
+			if supported[scheme] {
+				h.Compression = scheme
+				break
+			}
+		}
+	}
+	if err := writeJSON(c, h); err != nil {
+		fatalf("could not send file header: %v", err)
+	}
+	var offset int64
+	sum := sha256.New()
+	if h.Resume {
+		offset, sum, err = negotiateOffset(c, f, int64(h.Size))
+		if err != nil {
+			fatalf("could not resume file %s: %v", it.path, err)
+		}
+	}
+	var w io.Writer = c
+	var frames *frameWriter
+	if h.Stream {
+		frames = &frameWriter{w: c}
+		w = frames
+	}
+	if h.Compression != "" {
+		w, err = compress.NewWriter(w, h.Compression)
 		if err != nil {
+			fatalf("could not compress file %s: %v", it.path, err)
+		}
+	}
+	label := fmt.Sprintf("sending %v", h.Name)
+	if offset > 0 {
+		label = fmt.Sprintf("resuming %v from %v bytes", h.Name, offset)
+	}
+	size := int64(h.Size)
+	var data io.Reader = io.LimitReader(f, size-offset)
+	if h.Stream {
+		size, data = -1, f
+	}
+	written, err := p.copy(w, io.TeeReader(data, sum), h.Name, label, size, offset)
+	if err != nil {
+		fatalf("\ncould not send file: %v", err)
+	}
+	if h.Stream {
+		if err := frames.Close(); err != nil {
 			fatalf("\ncould not send file: %v", err)
 		}
-		if written != info.Size() {
-			fatalf("\nEOF before sending all bytes: (%d/%d)", written, info.Size())
+		fmt.Fprintf(msgs, "%s... done\n", label)
+		size = written
+	} else if offset+written != size {
+		fatalf("\nEOF before sending all bytes: (%d/%d)", offset+written, h.Size)
+	}
+	if h.SHA256 {
+		err := writeJSON(c, trailer{Type: trailerType, SHA256: sum.Sum(nil)})
+		if err != nil {
+			fatalf("\ncould not send file trailer: %v", err)
 		}
-		f.Close()
-		fmt.Fprintf(set.Output(), "done\n")
 	}
-	c.Close()
+	emitFinish(h.Name, size, size, sum.Sum(nil))
+}
+
+// negotiateOffset reads how much of f the receiver already has, checks it
+// has the same bytes, and tells it where f will be sent from. f is left
+// positioned there. It also returns a hash of the part of f before that.
+func negotiateOffset(c *wormhole.Wormhole, f *os.File, size int64) (int64, hash.Hash, error) {
+	var have resume
+	if err := readJSON(c, &have); err != nil {
+		return 0, nil, err
+	}
+	if have.Type != offsetType {
+		return 0, nil, fmt.Errorf("unexpected message %q", have.Type)
+	}
+	start := resume{Type: startType}
+	sum := sha256.New()
+	if have.Offset > 0 && have.Offset <= size {
+		prefix, err := hashPrefix(f, have.Offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		if bytes.Equal(prefix.Sum(nil), have.Hash) {
+			start.Offset = have.Offset
+			sum = prefix
+		} else {
+			logf("receiver has a different partial file, starting over")
+		}
+	}
+	if _, err := f.Seek(start.Offset, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	return start.Offset, sum, writeJSON(c, start)
 }
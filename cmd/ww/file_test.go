@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"webwormhole.io/compress"
+	"webwormhole.io/wormhole"
+)
+
+// connect returns two peers connected over a Pipe. They are closed when the
+// test finishes.
+func connect(t *testing.T) (a, b *wormhole.Wormhole) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	sigA, sigB := wormhole.Pipe("1")
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		a, err = wormhole.AcceptSignaller(ctx, "password", sigA, nil, testConfig())
+		errc <- err
+	}()
+	b, err := wormhole.DialSignaller(ctx, "password", sigB, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		b.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Give the peers time to acknowledge what they were sent last,
+		// which SCTP delays for up to 200ms, so that closing does not
+		// wait for acknowledgements that will never come.
+		time.Sleep(250 * time.Millisecond)
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+// writeFile writes a file called name in dir, and returns its path.
+func writeFile(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestResume(t *testing.T) {
+	a, b := connect(t)
+	const data = "hello world"
+	cases := []struct {
+		name string
+		// part is what the receiver has of the file, if anything.
+		part   string
+		offset int64
+	}{
+		{"no part", "", 0},
+		{"prefix", "hello", 5},
+		{"whole", data, int64(len(data))},
+		{"different prefix", "jello", 0},
+		{"longer than file", data + ", again", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, err := os.Open(writeFile(t, dir, "src", data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.Close()
+			name := filepath.Join(dir, "dst")
+			if c.part != "" {
+				writeFile(t, dir, "dst"+partSuffix, c.part)
+			}
+
+			type result struct {
+				offset int64
+				sum    []byte
+				err    error
+			}
+			sent := make(chan result, 1)
+			go func() {
+				offset, sum, err := negotiateOffset(a, src, int64(len(data)))
+				sent <- result{offset, sum.Sum(nil), err}
+			}()
+			f, offset, sum, err := openPart(b, name, header{Size: len(data), Resume: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			s := <-sent
+			if s.err != nil {
+				t.Fatal(s.err)
+			}
+
+			if offset != c.offset || s.offset != c.offset {
+				t.Errorf("receiver resumed from %v and sender from %v, want %v", offset, s.offset, c.offset)
+			}
+			want := sha256.Sum256([]byte(data[:c.offset]))
+			if !bytes.Equal(sum.Sum(nil), want[:]) || !bytes.Equal(s.sum, want[:]) {
+				t.Errorf("receiver hashed %x and sender %x, want %x", sum.Sum(nil), s.sum, want)
+			}
+			for _, f := range []*os.File{f, src} {
+				if pos, _ := f.Seek(0, io.SeekCurrent); pos != c.offset {
+					t.Errorf("%v is at %v, want %v", f.Name(), pos, c.offset)
+				}
+			}
+			// Anything after what was resumed is dropped.
+			if info, err := f.Stat(); err != nil || info.Size() != c.offset {
+				t.Errorf("%v is %v bytes, want %v", f.Name(), info.Size(), c.offset)
+			}
+		})
+	}
+
+	t.Run("declined", func(t *testing.T) {
+		dir := t.TempDir()
+		src, err := os.Open(writeFile(t, dir, "src", data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- declineResume(b)
+		}()
+		offset, _, err := negotiateOffset(a, src, int64(len(data)))
+		if err != nil || offset != 0 {
+			t.Errorf("sender resumed from %v, %v want 0", offset, err)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("receiver could not decline: %v", err)
+		}
+	})
+}
+
+func TestLocalPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"link", filepath.Join("dir", "link")} {
+		if err := os.Symlink(outside, filepath.Join(root, link)); err != nil {
+			t.Skipf("cannot create symbolic links: %v", err)
+		}
+	}
+	for _, c := range []struct {
+		name string
+		want string // empty if it should be refused
+	}{
+		{"file", "file"},
+		{"dir/file", filepath.Join("dir", "file")},
+		{"./dir//file", filepath.Join("dir", "file")},
+		{"new/dir/file", filepath.Join("new", "dir", "file")},
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../file", ""},
+		{"dir/../../file", ""},
+		{"dir/../file", ""},
+		{"/etc/passwd", ""},
+		{"/file", ""},
+		{"link", ""},
+		{"link/file", ""},
+		{"dir/link/file", ""},
+	} {
+		got, err := localPath(root, c.name)
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("localPath(%q) = %q, want an error", c.name, got)
+		case c.want != "" && err != nil:
+			t.Errorf("localPath(%q) failed: %v", c.name, err)
+		case c.want != "" && got != filepath.Join(root, c.want):
+			t.Errorf("localPath(%q) = %q, want %q", c.name, got, filepath.Join(root, c.want))
+		}
+	}
+}
+
+func TestOpenPartSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := writeFile(t, t.TempDir(), "target", "precious")
+	name := filepath.Join(dir, "file")
+	writeFile(t, dir, "file", "taken")
+	// The name is only free once renamed, so it is the partial file of that
+	// name that has to be checked, not that of the one the peer sent.
+	name, err := resolveExisting(io.Discard, name, policyRename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, name+partSuffix); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	if f, _, _, err := openPart(nil, name, header{Size: 1}); err == nil {
+		f.Close()
+		t.Errorf("opened %v through a symbolic link", name+partSuffix)
+	}
+	if b, err := os.ReadFile(target); err != nil || string(b) != "precious" {
+		t.Errorf("link target is %q, %v, want it untouched", b, err)
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	a, b := connect(t)
+	p := &progress{out: io.Discard}
+	data := bytes.Repeat([]byte("hello world\n"), 1000)
+
+	t.Run("round trip", func(t *testing.T) {
+		dir := t.TempDir()
+		src := writeFile(t, dir, "src.txt", string(data))
+		name := filepath.Join(dir, "dst.txt")
+		// Half the file is resumed, so the hash has to cover both parts.
+		writeFile(t, dir, "dst.txt"+partSuffix, string(data[:len(data)/2]))
+		supported := map[string]bool{featureResume: true, featureSHA256: true}
+		for _, scheme := range compress.Schemes {
+			supported[scheme] = true
+		}
+		go sendFile(a, p, item{path: src, h: header{Name: "src.txt", Size: len(data)}}, supported)
+
+		var h header
+		if err := readJSON(b, &h); err != nil {
+			t.Fatal(err)
+		}
+		if !h.SHA256 {
+			t.Fatal("sender sent no trailer")
+		}
+		n, sum, err := receiveFile(b, p, name, h, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := sha256.Sum256(data)
+		if n != int64(len(data)) || !bytes.Equal(sum, want[:]) {
+			t.Errorf("received %v bytes with SHA-256 %x, want %v bytes with %x", n, sum, len(data), want)
+		}
+		if got, err := os.ReadFile(name); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("received %v bytes, %v", len(got), err)
+		}
+		if _, err := os.Stat(name + partSuffix); err == nil {
+			t.Errorf("%v was left behind", name+partSuffix)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		dir := t.TempDir()
+		name := filepath.Join(dir, "dst.txt")
+		go func() {
+			a.Write(data)
+			writeJSON(a, trailer{Type: trailerType, SHA256: make([]byte, sha256.Size)})
+		}()
+		_, _, err := receiveFile(b, p, name, header{Name: "dst.txt", Size: len(data), SHA256: true}, 0)
+		if err == nil {
+			t.Fatal("received a file with the wrong hash")
+		}
+		if _, err := os.Stat(name); err == nil {
+			t.Errorf("%v was saved", name)
+		}
+		if got, err := os.ReadFile(name + corruptSuffix); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("kept %v bytes of what was received, %v", len(got), err)
+		}
+	})
+}
+
+func TestStripControl(t *testing.T) {
+	for in, want := range map[string]string{
+		"hello, world":                  "hello, world",
+		"line\n\tindented\n":            "line\n\tindented\n",
+		"\x1b]0;title\x07red \x1b[31m!": "]0;titlered [31m!",
+		"carriage\rreturn\x00":          "carriagereturn",
+		"del\x7f c1\u009b":              "del c1",
+		"héllo, 世界":                     "héllo, 世界",
+	} {
+		if got := stripControl(in); got != want {
+			t.Errorf("stripControl(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+// Peers speak the original file transfer protocol, a JSON header followed by
+// the file's data, unless the receiving peer says it supports extensions to
+// it. It does so in a hello message sent on a DataChannel of its own, which
+// older peers ignore instead of mistaking it for a file header.
+//
+// The sender only uses extensions the receiver supports, and marks the
+// headers of files that use them.
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"webwormhole.io/compress"
+	"webwormhole.io/wormhole"
+)
+
+// helloLabel is the label of the DataChannel hello is sent on.
+const helloLabel = "webwormhole-hello"
+
+// helloTimeout is how long to wait for a hello before assuming the remote
+// peer doesn't support any extensions.
+const helloTimeout = 3 * time.Second
+
+// Extensions to the file transfer protocol.
+const (
+	// featureResume is resuming partially received files.
+	featureResume = "resume"
+	// featureDirs is sending directories. Names of files in them are
+	// slash-separated relative paths.
+	featureDirs = "dirs"
+	// featureSHA256 is following files with a trailer with their SHA-256
+	// hash.
+	featureSHA256 = "sha256"
+	// featureManifest is asking the receiver to accept files before sending
+	// them.
+	featureManifest = "manifest"
+	// featureStream is sending files of unknown size as streams.
+	featureStream = "stream"
+	// featureText is sending text messages. Older peers would save them
+	// as files named after the text.
+	featureText = "text"
+)
+
+// features lists the extensions this implementation supports. Each of the
+// compression schemes in compress.Schemes is an extension too, for
+// compressing file data with that scheme.
+var features = append([]string{featureResume, featureDirs, featureSHA256, featureManifest, featureStream, featureText}, compress.Schemes...)
+
+type hello struct {
+	Features []string `json:"features"`
+}
+
+// sendHello tells the remote peer the extensions we support.
+func sendHello(c *wormhole.Wormhole) error {
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+	s, err := c.OpenStream(ctx, helloLabel, nil)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(hello{Features: features})
+	if err != nil {
+		return err
+	}
+	_, err = s.Write(buf)
+	return err
+}
+
+// readHello waits for the remote peer to say which extensions it supports.
+// It returns none if the peer doesn't say in time.
+func readHello(c *wormhole.Wormhole) map[string]bool {
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+	supported := make(map[string]bool)
+	for {
+		s, err := c.AcceptStream(ctx)
+		if err != nil {
+			logf("peer did not send hello: %v", err)
+			return supported
+		}
+		if s.Label() != helloLabel {
+			continue
+		}
+		var h hello
+		if err := readJSON(s, &h); err != nil {
+			logf("could not read hello: %v", err)
+			return supported
+		}
+		for _, f := range h.Features {
+			supported[f] = true
+		}
+		logf("peer supports: %v", h.Features)
+		return supported
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+// This is signalling on the local network. The peer waiting on a slot serves
+// the signalling protocol itself, over a WebSocket on an ephemeral port, and
+// advertises it using multicast DNS. The peer joining finds it and connects
+// directly, then both run the same handshake they would via a signalling
+// server.
+//
+// It is only used with -lan. The peer joining only looks on the local network
+// if it can't reach the signalling server, whatever the slot. The peer
+// waiting runs a separate handshake over each, and the first to complete
+// wins. Anyone on the local network can try a handshake, so one that fails
+// over either ends the wormhole, as it would through the signalling server.
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+	"webwormhole.io/signal"
+	"webwormhole.io/wordlist"
+	"webwormhole.io/wormhole"
+)
+
+const (
+	// lanTimeout is how long to look for a peer on the local network.
+	lanTimeout = 30 * time.Second
+
+	// lanBrowseTimeout is how long to wait for the peers on the local
+	// network to say which slots they are waiting on.
+	lanBrowseTimeout = time.Second
+)
+
+var (
+	// errNoLANPeer is returned when no peer on the local network answers.
+	errNoLANPeer = errors.New("no peer found on the local network")
+
+	// errNoLANSlots is returned when peers on the local network are
+	// waiting on all the slots reserved for it.
+	errNoLANSlots = errors.New("no free slots on the local network")
+)
+
+// listenLAN serves the signalling protocol for slot on the local network and
+// advertises it. The returned Signaller is connected to the first peer that
+// joins.
+func listenLAN(slot string) (wormhole.Signaller, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := newPendingSignaller(slot, cancel)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: wormhole.Protocols,
+		})
+		if err != nil {
+			logf("could not accept local peer: %v", err)
+			return
+		}
+		if !signal.SupportedProtocol(conn.Subprotocol()) {
+			conn.Close(wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
+			return
+		}
+		if r.URL.Path != "/"+slot {
+			conn.Close(wormhole.CloseNoSuchSlot, "no such slot")
+			return
+		}
+		// Send what the signalling server would.
+		buf, err := json.Marshal(struct {
+			Slot string `json:"slot"`
+		}{slot})
+		if err != nil {
+			conn.Close(websocket.StatusInternalError, "")
+			return
+		}
+		if err := conn.Write(ctx, websocket.MessageText, buf); err != nil {
+			return
+		}
+		if !sig.resolve(wormhole.NewWebSocketSignaller(conn, slot, nil), nil) {
+			conn.Close(wormhole.CloseNoSuchSlot, "no such slot")
+			return
+		}
+		logf("local peer joined from %v", r.RemoteAddr)
+		// Only one peer can join.
+		cancel()
+	})}
+	go srv.Serve(l)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	go func() {
+		err := mdnsAdvertise(ctx, slot, port)
+		if err != nil {
+			logf("could not advertise on the local network: %v", err)
+		}
+	}()
+	logf("waiting for local peers on port %v", port)
+	return sig, nil
+}
+
+// dialLAN looks for the peer waiting on slot on the local network, and
+// returns a Signaller that connects to it once found.
+func dialLAN(slot string) wormhole.Signaller {
+	ctx, cancel := context.WithTimeout(context.Background(), lanTimeout)
+	sig := newPendingSignaller(slot, cancel)
+	go func() {
+		addr, err := mdnsLookup(ctx, slot)
+		if err == context.DeadlineExceeded {
+			err = errNoLANPeer
+		}
+		if err != nil {
+			logf("could not find local peer: %v", err)
+			sig.resolve(nil, err)
+			return
+		}
+		logf("found local peer at %v", addr)
+		ws, err := wormhole.DialWebSocket(ctx, "http://"+addr.String()+"/", slot, &wormhole.Config{
+			// Never go through a proxy on the local network.
+			HTTPClient: &http.Client{Transport: &http.Transport{}},
+		})
+		if err != nil {
+			logf("could not connect to local peer: %v", err)
+			sig.resolve(nil, err)
+			return
+		}
+		if !sig.resolve(ws, nil) {
+			ws.Close(int(websocket.StatusNormalClosure), "")
+		}
+	}()
+	return sig
+}
+
+// pendingSignaller is a Signaller that is connected at some point after it
+// is created. Messages sent before then are queued.
+type pendingSignaller struct {
+	slot   string
+	cancel context.CancelFunc
+
+	// ready is closed once the signaller is connected or failed.
+	ready chan struct{}
+
+	mu    sync.Mutex
+	done  bool
+	sig   wormhole.Signaller
+	err   error
+	queue [][]byte
+}
+
+func newPendingSignaller(slot string, cancel context.CancelFunc) *pendingSignaller {
+	return &pendingSignaller{
+		slot:   slot,
+		cancel: cancel,
+		ready:  make(chan struct{}),
+	}
+}
+
+// resolve connects p to sig, or fails it with err. It returns false if p
+// was already connected, failed, or closed.
+func (p *pendingSignaller) resolve(sig wormhole.Signaller, err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return false
+	}
+	p.done = true
+	p.sig, p.err = sig, err
+	for _, msg := range p.queue {
+		if p.err != nil {
+			break
+		}
+		p.err = p.sig.Send(context.Background(), msg)
+	}
+	p.queue = nil
+	close(p.ready)
+	return true
+}
+
+func (p *pendingSignaller) Slot() (string, []webrtc.ICEServer) {
+	return p.slot, nil
+}
+
+func (p *pendingSignaller) Send(ctx context.Context, msg []byte) error {
+	p.mu.Lock()
+	if !p.done {
+		p.queue = append(p.queue, append([]byte(nil), msg...))
+		p.mu.Unlock()
+		return nil
+	}
+	sig, err := p.sig, p.err
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return sig.Send(ctx, msg)
+}
+
+func (p *pendingSignaller) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.sig.Receive(ctx)
+}
+
+func (p *pendingSignaller) Close(code int, reason string) error {
+	p.cancel()
+	if p.resolve(nil, net.ErrClosed) {
+		return nil
+	}
+	if p.sig == nil {
+		return nil
+	}
+	return p.sig.Close(code, reason)
+}
+
+// acceptFirst runs the handshake for a new wormhole over each of sigs at
+// once, and returns the first to connect, abandoning the others. It fails
+// when the handshake over the first of sigs does, or when anyone gets the
+// password wrong over any of them, since the code is no good after either.
+// Other failures over the others are only logged.
+func acceptFirst(ctx context.Context, pass string, cfg *wormhole.Config, sigs ...wormhole.Signaller) (*wormhole.Wormhole, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		i   int
+		c   *wormhole.Wormhole
+		err error
+	}
+	resc := make(chan result, len(sigs))
+	for i, sig := range sigs {
+		go func(i int, sig wormhole.Signaller) {
+			c, err := wormhole.AcceptSignaller(ctx, pass, sig, nil, cfg)
+			resc <- result{i, c, err}
+		}(i, sig)
+	}
+	// The handshake over sigs[0] always ends the loop, as does a wrong
+	// password over any of them, so nobody gets more than one guess.
+	for pending := len(sigs); ; pending-- {
+		r := <-resc
+		if r.err != nil && r.i != 0 && !errors.Is(r.err, wormhole.ErrBadKey) {
+			logf("could not connect over signaller %v: %v", r.i, r.err)
+			continue
+		}
+		// Close the losers, in case any connects before it notices it was
+		// abandoned.
+		go func(losers int) {
+			for ; losers > 0; losers-- {
+				if r := <-resc; r.err == nil {
+					r.c.Close()
+				}
+			}
+		}(pending - 1)
+		return r.c, r.err
+	}
+}
+
+// lanSlot returns a random slot from the range reserved for the local
+// network that no other peer on it is waiting on.
+func lanSlot(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, lanBrowseTimeout)
+	defer cancel()
+	taken, err := mdnsBrowse(ctx)
+	if err != nil {
+		return "", err
+	}
+	var free []string
+	for n := wordlist.LocalSlotMin; n <= wordlist.LocalSlotMax; n++ {
+		if slot := strconv.Itoa(n); !taken[slot] {
+			free = append(free, slot)
+		}
+	}
+	if len(free) == 0 {
+		return "", errNoLANSlots
+	}
+	var b [1]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return free[int(b[0])%len(free)], nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"webwormhole.io/wormhole"
+)
+
+// testConfig returns a Config that can connect over the loopback interface.
+func testConfig() *wormhole.Config {
+	return &wormhole.Config{
+		OverrideICEServers: true,
+		SettingEngine: func(s *webrtc.SettingEngine) {
+			s.SetIncludeLoopbackCandidate(true)
+		},
+	}
+}
+
+// join joins a wormhole over sig with pass, and returns the error it gets.
+func join(ctx context.Context, t *testing.T, pass string, sig wormhole.Signaller) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		c, err := wormhole.DialSignaller(ctx, pass, sig, testConfig())
+		if err == nil {
+			t.Cleanup(func() { c.Close() })
+		}
+		errc <- err
+	}()
+	return errc
+}
+
+func TestAcceptFirst(t *testing.T) {
+	cases := []struct {
+		name string
+		// pass is the password the peer on each path uses, or empty if
+		// there is nobody on it.
+		pass    [2]string
+		wantErr error
+	}{
+		{"first", [2]string{"password", ""}, nil},
+		{"second", [2]string{"", "password"}, nil},
+		{"interloper on second", [2]string{"password", "wrong"}, wormhole.ErrBadKey},
+		{"interloper on first", [2]string{"wrong", ""}, wormhole.ErrBadKey},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			var sigs, peers []wormhole.Signaller
+			for range c.pass {
+				a, b := wormhole.Pipe("1")
+				sigs = append(sigs, a)
+				peers = append(peers, b)
+			}
+			// Interlopers go first.
+			var errcs [2]<-chan error
+			for i, pass := range c.pass {
+				if pass != "" && pass != "password" {
+					errcs[i] = join(ctx, t, pass, peers[i])
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+			for i, pass := range c.pass {
+				if pass == "password" {
+					errcs[i] = join(ctx, t, pass, peers[i])
+				}
+			}
+
+			conn, err := acceptFirst(ctx, "password", testConfig(), sigs...)
+			if err != c.wantErr {
+				t.Fatalf("got %v want %v", err, c.wantErr)
+			}
+			if err == nil {
+				conn.Close()
+			}
+			for i, pass := range c.pass {
+				switch pass {
+				case "":
+					// Nobody is there, so the path was abandoned.
+					if _, err := peers[i].Receive(ctx); err == nil {
+						t.Errorf("path %v: got message, want it closed", i)
+					}
+				case "password":
+					// The peer can't get in after an interloper.
+					if err := <-errcs[i]; (err != nil) != (c.wantErr != nil) {
+						t.Errorf("path %v: peer got %v", i, err)
+					}
+				default:
+					if err := <-errcs[i]; err != wormhole.ErrBadKey {
+						t.Errorf("path %v: interloper got %v want %v", i, err, wormhole.ErrBadKey)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPendingSignaller(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := newPendingSignaller("1", func() {})
+	// Messages sent before the signaller is connected are queued.
+	if err := p.Send(ctx, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		msg, err := p.Receive(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- string(msg)
+	}()
+	a, b := wormhole.Pipe("1")
+	if !p.resolve(a, nil) {
+		t.Fatal("could not connect")
+	}
+	if p.resolve(a, nil) {
+		t.Error("connected twice")
+	}
+	if msg, err := b.Receive(ctx); err != nil || string(msg) != "hello" {
+		t.Errorf("got %q, %v want %q", msg, err, "hello")
+	}
+	if err := b.Send(ctx, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg != "world" {
+		t.Errorf("got %q want %q", msg, "world")
+	}
+
+	closed := newPendingSignaller("1", func() {})
+	closed.Close(0, "")
+	if _, err := closed.Receive(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("receive after close got %v want %v", err, net.ErrClosed)
+	}
+	if closed.resolve(a, nil) {
+		t.Error("connected after close")
+	}
+}
@@ -5,13 +5,16 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 
 	"rsc.io/qr"
 	"webwormhole.io/wordlist"
@@ -28,10 +31,17 @@ var subcmds = map[string]func(args ...string){
 var (
 	verbose bool   = false
 	sigserv string = "https://webwormhole.io"
+	manual  bool   = false
+	lan     bool   = false
+
+	jsonOutput bool = false
 )
 
 var stderr = flag.CommandLine.Output()
 
+// msgs is where messages for people go. It discards them with -json.
+var msgs = stderr
+
 func usage() {
 	fmt.Fprintf(stderr, "webwormhole creates ephemeral pipes between computers.\n\n")
 	fmt.Fprintf(stderr, "usage:\n\n")
@@ -47,15 +57,18 @@ func usage() {
 func main() {
 	flag.BoolVar(&verbose, "verbose", LookupEnvOrBool("WW_VERBOSE", verbose), "verbose logging")
 	flag.StringVar(&sigserv, "signal", LookupEnvOrString("WW_SIGSERV", sigserv), "signalling server to use")
+	flag.BoolVar(&manual, "manual", manual, "exchange signalling messages by hand instead of using a signalling server")
+	flag.BoolVar(&lan, "lan", LookupEnvOrBool("WW_LAN", lan), "also look for peers on the local network")
+	flag.BoolVar(&jsonOutput, "json", jsonOutput, "print events as JSON lines on stderr instead of messages")
 	flag.Usage = usage
 	flag.Parse()
+	if jsonOutput {
+		msgs = io.Discard
+	}
 	if flag.NArg() < 1 {
 		usage()
 		os.Exit(2)
 	}
-	if verbose {
-		wormhole.Verbose = true
-	}
 	cmd, ok := subcmds[flag.Arg(0)]
 	if !ok {
 		flag.Usage()
@@ -65,18 +78,41 @@ func main() {
 }
 
 func fatalf(format string, v ...interface{}) {
+	if jsonOutput {
+		emitError(strings.TrimSpace(fmt.Sprintf(format, v...)), v...)
+		os.Exit(1)
+	}
 	fmt.Fprintf(stderr, format+"\n", v...)
 	os.Exit(1)
 }
 
+func logf(format string, v ...interface{}) {
+	if verbose {
+		log.Printf(format, v...)
+	}
+}
+
 func newConn(code string, length int) *wormhole.Wormhole {
+	cfg := &wormhole.Config{}
+	if verbose {
+		cfg.Logger = log.New(stderr, "", log.LstdFlags)
+	}
+	if manual {
+		// The user won't carry any more messages after the answer.
+		cfg.NoTrickle = true
+	}
+	ctx := context.Background()
 	if code != "" {
 		// Join wormhole.
 		slot, pass := wordlist.Decode(code)
 		if pass == nil {
 			fatalf("could not decode password")
 		}
-		c, err := wormhole.Join(strconv.Itoa(slot), string(pass), sigserv)
+		sig, err := joinSignaller(ctx, slot, cfg)
+		var c *wormhole.Wormhole
+		if err == nil {
+			c, err = wormhole.DialSignaller(ctx, string(pass), sig, cfg)
+		}
 		if err == wormhole.ErrBadVersion {
 			fatalf(
 				"%s%s%s",
@@ -88,11 +124,7 @@ func newConn(code string, length int) *wormhole.Wormhole {
 		if err != nil {
 			fatalf("could not dial: %v", err)
 		}
-		if c.IsRelay() {
-			fmt.Fprintf(stderr, "connected: relay\n")
-		} else {
-			fmt.Fprintf(stderr, "connected: direct\n")
-		}
+		printconn(c)
 		return c
 	}
 	// New wormhole.
@@ -100,16 +132,19 @@ func newConn(code string, length int) *wormhole.Wormhole {
 	if _, err := io.ReadFull(crand.Reader, pass); err != nil {
 		fatalf("could not generate password: %v", err)
 	}
-	slotc := make(chan string)
-	go func() {
-		s := <-slotc
-		slot, err := strconv.Atoi(s)
+	attempts := 0
+	c, err := wormhole.RetryDrained(ctx, cfg, func() (*wormhole.Wormhole, error) {
+		if attempts++; attempts > 1 {
+			// The code we printed is no good any more.
+			fmt.Fprintf(msgs, "the signalling server is shutting down, getting a new code...\n")
+		}
+		sigs, err := newSignallers(ctx, cfg)
 		if err != nil {
-			fatalf("got invalid slot from signalling server: %v", s)
+			return nil, err
 		}
-		printcode(wordlist.Encode(slot, pass))
-	}()
-	c, err := wormhole.New(string(pass), sigserv, slotc)
+		printslot(sigs[0], pass)
+		return acceptFirst(ctx, string(pass), cfg, sigs...)
+	})
 	if err == wormhole.ErrBadVersion {
 		fatalf(
 			"%s%s%s",
@@ -121,58 +156,175 @@ func newConn(code string, length int) *wormhole.Wormhole {
 	if err != nil {
 		fatalf("could not dial: %v", err)
 	}
+	printconn(c)
+	return c
+}
+
+// printslot prints the code for the slot of sig and pass.
+func printslot(sig wormhole.Signaller, pass []byte) {
+	s, _ := sig.Slot()
+	switch slot, err := strconv.Atoi(s); {
+	case manual:
+		// There's no slot, so the code only carries the password.
+		code := wordlist.Encode(0, pass)
+		fmt.Fprintf(msgs, "%s\n", code)
+		emit(codeEvent{Event: "code", Code: code})
+	case err != nil:
+		fatalf("got invalid slot from signalling server: %v", s)
+	case wordlist.IsLocal(slot):
+		// The web client can't use local slots, so there's no link.
+		code := wordlist.Encode(slot, pass)
+		fmt.Fprintf(msgs, "%s\n", code)
+		emit(codeEvent{Event: "code", Code: code, Slot: s})
+	default:
+		printcode(wordlist.Encode(slot, pass), s)
+	}
+}
+
+// newSignallers returns the Signallers for a new wormhole, the first of
+// which decides the slot. It waits on a new slot on the signalling server
+// and, with -lan, on the local network too. If the signalling server can't
+// be reached with -lan, it waits only on the local network, on a slot
+// reserved for it.
+func newSignallers(ctx context.Context, cfg *wormhole.Config) ([]wormhole.Signaller, error) {
+	if manual {
+		return []wormhole.Signaller{newManualSignaller()}, nil
+	}
+	sig, err := wormhole.DialWebSocket(ctx, sigserv, "", cfg)
+	if !lan || !unreachable(err) {
+		if err != nil {
+			return nil, err
+		}
+		if !lan {
+			return []wormhole.Signaller{sig}, nil
+		}
+		slot, _ := sig.Slot()
+		local, err := listenLAN(slot)
+		if err != nil {
+			logf("could not listen on the local network: %v", err)
+			return []wormhole.Signaller{sig}, nil
+		}
+		return []wormhole.Signaller{sig, local}, nil
+	}
+	fmt.Fprintf(msgs, "could not reach signalling server, using local network: %v\n", err)
+	slot, err := lanSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local, err := listenLAN(slot)
+	if err != nil {
+		return nil, err
+	}
+	return []wormhole.Signaller{local}, nil
+}
+
+// joinSignaller returns the Signaller to join slot. It is joined on the
+// signalling server or, with -lan, looked for on the local network if that
+// can't be reached. Slots reserved for the local network go to the server
+// first too, since servers from before they were reserved hand them out.
+func joinSignaller(ctx context.Context, slot int, cfg *wormhole.Config) (wormhole.Signaller, error) {
+	if manual {
+		return newManualSignaller(), nil
+	}
+	sig, err := wormhole.DialWebSocket(ctx, sigserv, strconv.Itoa(slot), cfg)
+	if !lan || !unreachable(err) {
+		return sig, err
+	}
+	fmt.Fprintf(msgs, "could not reach signalling server, using local network: %v\n", err)
+	return dialLAN(strconv.Itoa(slot)), nil
+}
+
+// unreachable reports whether err, from dialing the signalling server, means
+// it couldn't be reached, rather than that it turned us away.
+func unreachable(err error) bool {
+	return err != nil && closeCode(err) == 0
+}
+
+// fingerprintColours are the names of the background colours the web client
+// uses to display a fingerprint, indexed by the first byte modulo 8.
+var fingerprintColours = []string{
+	"bright green", "brown", "gold", "teal", "grey", "blue", "lime", "purple",
+}
+
+// printconn prints the connection type and key fingerprint of c. The words
+// and colour match what the web client shows for the same wormhole.
+func printconn(c *wormhole.Wormhole) {
+	route := "direct"
 	if c.IsRelay() {
-		fmt.Fprintf(stderr, "connected: relay\n")
-	} else {
-		fmt.Fprintf(stderr, "connected: direct\n")
+		route = "relay"
 	}
-	return c
+	fmt.Fprintf(msgs, "connected: %s\n", route)
+	fp := c.Fingerprint()
+	// The web client encodes the fingerprint like a code with slot 0, and
+	// drops the slot's word.
+	words := wordlist.Encode(0, fp[1:])
+	words = words[strings.Index(words, "-")+1:]
+	fmt.Fprintf(msgs, "fingerprint: %s %x (%s)\n", words, fp, fingerprintColours[fp[0]%8])
+	local, remote := c.CandidateTypes()
+	emit(connectedEvent{
+		Event:           "connected",
+		Route:           route,
+		LocalCandidate:  local,
+		RemoteCandidate: remote,
+		Fingerprint:     fmt.Sprintf("%x", fp),
+	})
 }
 
-func printcode(code string) {
-	fmt.Fprintf(stderr, "%s\n", code)
+// printcode prints the code for slot, and a link and QR code for the web
+// client to join with.
+func printcode(code, slot string) {
+	fmt.Fprintf(msgs, "%s\n", code)
 	u, err := url.Parse(sigserv)
 	if err != nil {
+		emit(codeEvent{Event: "code", Code: code, Slot: slot})
 		return
 	}
 	u.Fragment = code
-	qrcode, err := qr.Encode(u.String(), qr.L)
+	printqr(msgs, u.String())
+	fmt.Fprintf(msgs, "%s\n", u.String())
+	emit(codeEvent{Event: "code", Code: code, Slot: slot, URL: u.String()})
+}
+
+// printqr prints s as a QR code to w. Nothing is printed, and an error is
+// returned, if s is too long to fit in one.
+func printqr(w io.Writer, s string) error {
+	qrcode, err := qr.Encode(s, qr.L)
 	if err != nil {
-		return
+		return err
 	}
 	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(stderr, "█")
+		fmt.Fprintf(w, "█")
 	}
-	fmt.Fprintf(stderr, "████████\n")
+	fmt.Fprintf(w, "████████\n")
 	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(stderr, "█")
+		fmt.Fprintf(w, "█")
 	}
-	fmt.Fprintf(stderr, "████████\n")
+	fmt.Fprintf(w, "████████\n")
 	for y := 0; y < qrcode.Size; y += 2 {
-		fmt.Fprintf(stderr, "████")
+		fmt.Fprintf(w, "████")
 		for x := 0; x < qrcode.Size; x++ {
 			switch {
 			case qrcode.Black(x, y) && qrcode.Black(x, y+1):
-				fmt.Fprintf(stderr, " ")
+				fmt.Fprintf(w, " ")
 			case qrcode.Black(x, y):
-				fmt.Fprintf(stderr, "▄")
+				fmt.Fprintf(w, "▄")
 			case qrcode.Black(x, y+1):
-				fmt.Fprintf(stderr, "▀")
+				fmt.Fprintf(w, "▀")
 			default:
-				fmt.Fprintf(stderr, "█")
+				fmt.Fprintf(w, "█")
 			}
 		}
-		fmt.Fprintf(stderr, "████\n")
+		fmt.Fprintf(w, "████\n")
 	}
 	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(stderr, "█")
+		fmt.Fprintf(w, "█")
 	}
-	fmt.Fprintf(stderr, "████████\n")
+	fmt.Fprintf(w, "████████\n")
 	for x := 0; x < qrcode.Size; x++ {
-		fmt.Fprintf(stderr, "█")
+		fmt.Fprintf(w, "█")
 	}
-	fmt.Fprintf(stderr, "████████\n")
-	fmt.Fprintf(stderr, "%s\n", u.String())
+	fmt.Fprintf(w, "████████\n")
+	return nil
 }
 
 func LookupEnvOrBool(key string, defaultVal bool) bool {
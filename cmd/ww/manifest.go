@@ -0,0 +1,254 @@
+package main
+
+// Before sending any files, a sender whose peer supports it sends a manifest
+// of what it is about to send, and waits for the receiver to accept or
+// decline it. Nothing else is sent until the receiver replies. The manifest
+// covers the files up to the next manifest, so senders that don't know
+// everything they are going to send upfront can send several.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"webwormhole.io/wormhole"
+)
+
+// Types of the messages of the manifest extension.
+const (
+	manifestType = "application/webwormhole-manifest"
+	replyType    = "application/webwormhole-manifest-reply"
+)
+
+const (
+	// manifestNamesSize is the most bytes of file names to put in a
+	// manifest, so it fits in a message. Count has the number of all files.
+	manifestNamesSize = 32 << 10
+
+	// manifestNames is the most file names ww receive lists when asking.
+	manifestNames = 10
+)
+
+type manifest struct {
+	Type  string   `json:"type"`
+	Count int      `json:"count"`
+	Size  int64    `json:"size"`
+	Names []string `json:"names"`
+
+	// Streams is how many of the files are streams, whose sizes are not
+	// counted in Size.
+	Streams int `json:"streams,omitempty"`
+}
+
+type manifestReply struct {
+	Type   string `json:"type"`
+	Accept bool   `json:"accept"`
+}
+
+// offer sends the manifest for items and returns whether the receiver
+// accepted them.
+func offer(c *wormhole.Wormhole, items []item) (bool, error) {
+	m := manifest{Type: manifestType}
+	namesSize := 0
+	for _, it := range items {
+		if it.h.Type == dirType {
+			continue
+		}
+		m.Count++
+		m.Size += int64(it.h.Size)
+		if it.h.Stream {
+			m.Streams++
+		}
+		namesSize += len(it.h.Name)
+		if namesSize <= manifestNamesSize {
+			m.Names = append(m.Names, it.h.Name)
+		}
+	}
+	if err := writeJSON(c, m); err != nil {
+		return false, err
+	}
+	var reply manifestReply
+	if err := readJSON(c, &reply); err != nil {
+		return false, err
+	}
+	if reply.Type != replyType {
+		return false, fmt.Errorf("unexpected message %q", reply.Type)
+	}
+	return reply.Accept, nil
+}
+
+// decide shows m to the user and asks whether to accept it, unless maxSize
+// or yes decide for them. maxSize is ignored if it is zero.
+func decide(out io.Writer, m manifest, maxSize int64, yes bool) bool {
+	total := humanSize(m.Size) + " in total"
+	if m.Streams > 0 {
+		total += fmt.Sprintf(", not counting %d of unknown size", m.Streams)
+	}
+	fmt.Fprintf(out, "the other side wants to send %d files, %s:\n", m.Count, total)
+	shown := m.Names
+	if len(shown) > manifestNames {
+		shown = shown[:manifestNames]
+	}
+	for _, name := range shown {
+		fmt.Fprintf(out, "  %s\n", name)
+	}
+	if m.Count > len(shown) {
+		fmt.Fprintf(out, "  ...and %d more\n", m.Count-len(shown))
+	}
+	if maxSize > 0 && m.Size > maxSize {
+		fmt.Fprintf(out, "declining: more than -max-size %s\n", humanSize(maxSize))
+		return false
+	}
+	if yes {
+		return true
+	}
+	ok, err := ask(out, "accept? [y/N] ")
+	if err != nil {
+		fmt.Fprintf(out, "declining: could not ask: %v (use -yes to accept without asking)\n", err)
+		return false
+	}
+	return ok
+}
+
+// decideFile asks the user whether to accept a file from a sender that sent
+// no manifest, unless yes decides for them.
+func decideFile(out io.Writer, h header, yes bool) bool {
+	if yes {
+		return true
+	}
+	switch {
+	case h.Type == textType:
+		fmt.Fprintf(out, "the other side wants to send a text message\n")
+	case h.Stream:
+		fmt.Fprintf(out, "the other side wants to send %s, of unknown size\n", h.Name)
+	default:
+		fmt.Fprintf(out, "the other side wants to send %s, %s\n", h.Name, humanSize(int64(h.Size)))
+	}
+	ok, err := ask(out, "accept? [y/N] ")
+	if err != nil {
+		fmt.Fprintf(out, "declining: could not ask: %v (use -yes to accept without asking)\n", err)
+		return false
+	}
+	return ok
+}
+
+// allowance is what is left of a manifest the receiver accepted. Each file
+// that follows has to be one the manifest listed, and fit in what is left
+// of its count and size, or the sender is sending something other than
+// what the user agreed to.
+type allowance struct {
+	count   int
+	streams int
+	size    int64
+
+	// names counts the files the manifest listed by name. Manifests that
+	// ran out of room for names list only the first files, leaving
+	// unnamed files that can be called anything.
+	names   map[string]int
+	unnamed int
+}
+
+func newAllowance(m manifest) *allowance {
+	a := &allowance{
+		count:   m.Count,
+		streams: m.Streams,
+		size:    m.Size,
+		names:   make(map[string]int),
+		unnamed: m.Count - len(m.Names),
+	}
+	for _, name := range m.Names {
+		a.names[name]++
+	}
+	return a
+}
+
+// take counts the file h against what is left, or returns an error if it
+// does not fit. Directories, which manifests leave out, always fit.
+func (a *allowance) take(h header) error {
+	if h.Type == dirType {
+		return nil
+	}
+	switch {
+	case h.Size < 0:
+		return errors.New("negative size")
+	case a.count == 0:
+		return errors.New("more files than the manifest said")
+	case h.Stream && a.streams == 0:
+		return errors.New("more streams than the manifest said")
+	case !h.Stream && int64(h.Size) > a.size:
+		return errors.New("more bytes than the manifest said")
+	case a.names[h.Name] == 0 && a.unnamed == 0:
+		return errors.New("not in the manifest")
+	}
+	a.count--
+	if h.Stream {
+		a.streams--
+	} else {
+		a.size -= int64(h.Size)
+	}
+	if a.names[h.Name] > 0 {
+		a.names[h.Name]--
+	} else {
+		a.unnamed--
+	}
+	return nil
+}
+
+// ask asks the user a yes or no question on the terminal.
+func ask(out io.Writer, question string) (bool, error) {
+	answer, err := prompt(out, question)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// prompt asks the user a question on the terminal, falling back to out and
+// stdin, and returns the line they answer with.
+func prompt(out io.Writer, question string) (string, error) {
+	in := os.Stdin
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	fmt.Fprint(out, question)
+	// Read a byte at a time, so nothing past the line is consumed.
+	var line strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line.WriteByte(buf[0])
+		}
+		if err == io.EOF && line.Len() > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(line.String()), nil
+}
+
+// humanSize formats n bytes for people to read.
+func humanSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
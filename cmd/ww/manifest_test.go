@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestAllowance(t *testing.T) {
+	m := manifest{
+		Type:    manifestType,
+		Count:   4,
+		Size:    30,
+		Names:   []string{"a", "b", "a"},
+		Streams: 1,
+	}
+	for _, c := range []struct {
+		name    string
+		headers []header
+		// refused is the index of the first header that should be
+		// refused, or -1.
+		refused int
+	}{
+		{"all", []header{
+			{Name: "a", Size: 10},
+			{Name: "dir", Type: dirType},
+			{Name: "b", Size: 10},
+			{Name: "a", Size: 10},
+			{Name: "unlisted", Stream: true},
+		}, -1},
+		{"too many", []header{
+			{Name: "a", Size: 1},
+			{Name: "b", Size: 1},
+			{Name: "a", Size: 1},
+			{Name: "c", Size: 1},
+			{Name: "d", Size: 1},
+		}, 4},
+		{"too big", []header{{Name: "a", Size: 31}}, 0},
+		{"too big together", []header{{Name: "a", Size: 20}, {Name: "b", Size: 11}}, 1},
+		{"negative", []header{{Name: "a", Size: -10}}, 0},
+		{"listed too often", []header{{Name: "b"}, {Name: "b"}, {Name: "b"}}, 2},
+		{"unlisted", []header{{Name: "c"}, {Name: "d"}}, 1},
+		{"too many streams", []header{{Name: "a", Stream: true}, {Name: "b", Stream: true}}, 1},
+	} {
+		a := newAllowance(m)
+		for i, h := range c.headers {
+			err := a.take(h)
+			if err != nil && i != c.refused {
+				t.Errorf("%s: %q refused: %v", c.name, h.Name, err)
+			}
+			if err == nil && i == c.refused {
+				t.Errorf("%s: %q allowed", c.name, h.Name)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// This is manual signalling, for when there is no signalling server. The user
+// carries the handshake messages between the peers by copying and pasting
+// them or scanning them as QR codes.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// manualSignaller is a wormhole.Signaller that prints messages for the user
+// to give to the other side, and reads the ones the user gets back.
+type manualSignaller struct {
+	in io.Reader
+}
+
+func newManualSignaller() *manualSignaller {
+	// Prefer the terminal, so stdin is still free for pipe to use.
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		return &manualSignaller{in: tty}
+	}
+	return &manualSignaller{in: os.Stdin}
+}
+
+// Slot returns no slot or ICE servers. Manual signalling has no server to
+// rendezvous on.
+func (s *manualSignaller) Slot() (string, []webrtc.ICEServer) {
+	return "", nil
+}
+
+func (s *manualSignaller) Send(ctx context.Context, msg []byte) error {
+	fmt.Fprintf(stderr, "give this to the other side:\n")
+	if err := printqr(stderr, string(msg)); err != nil {
+		// Offers and answers with many candidates often are.
+		fmt.Fprintf(stderr, "(too long for a QR code, copy the text instead)\n")
+	}
+	fmt.Fprintf(stderr, "%s\n", msg)
+	return nil
+}
+
+// Receive reads a message from the user, one per line. It does not return
+// when ctx is done, since there is no way to interrupt the read.
+func (s *manualSignaller) Receive(ctx context.Context) ([]byte, error) {
+	for {
+		fmt.Fprintf(stderr, "enter the other side's message: ")
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			return []byte(line), nil
+		}
+	}
+}
+
+// readLine reads a line a byte at a time, so nothing past it is consumed
+// when reading from stdin.
+func (s *manualSignaller) readLine() (string, error) {
+	var b strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := s.in.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				return b.String(), nil
+			}
+			b.WriteByte(buf[0])
+		}
+		if err == io.EOF && b.Len() > 0 {
+			return b.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func (s *manualSignaller) Close(code int, reason string) error {
+	if c, ok := s.in.(io.Closer); ok && s.in != os.Stdin {
+		return c.Close()
+	}
+	return nil
+}
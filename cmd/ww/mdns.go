@@ -0,0 +1,277 @@
+package main
+
+// This is just enough multicast DNS (RFC 6762) service discovery (RFC 6763)
+// to find wormholes on the local network. A peer waiting on a slot advertises
+// it as an instance of the _webwormhole._tcp service, named after the slot,
+// and the peer joining asks for that instance.
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsService is the DNS-SD service name wormholes are advertised under.
+const mdnsService = "_webwormhole._tcp.local."
+
+// mdnsAddr is the IPv4 multicast DNS group.
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsInstance returns the DNS name of the service instance for slot.
+func mdnsInstance(slot string) string {
+	return slot + "." + mdnsService
+}
+
+// mdnsAdvertise answers multicast DNS queries for the instance for slot with
+// port, until ctx is done.
+func mdnsAdvertise(ctx context.Context, slot string, port int) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	instance := mdnsInstance(slot)
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, matched, ok := mdnsMatch(buf[:n], instance)
+		if !ok {
+			continue
+		}
+
+		// Queries not from port 5353 are one-shot queries, which get a
+		// unicast reply that echoes the ID and questions.
+		dst := mdnsAddr
+		if src.Port != mdnsAddr.Port {
+			dst = src
+		} else {
+			id = 0
+			matched = nil
+		}
+		resp, err := mdnsResponse(id, matched, instance, port)
+		if err != nil {
+			return err
+		}
+		conn.WriteToUDP(resp, dst)
+	}
+}
+
+// mdnsMatch parses query msg, and returns its ID and the questions in it
+// that the advertiser of instance answers, if there are any.
+func mdnsMatch(msg []byte, instance string) (id uint16, matched []dnsmessage.Question, ok bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Response {
+		return 0, nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return 0, nil, false
+	}
+	for _, q := range questions {
+		name := q.Name.String()
+		switch {
+		case strings.EqualFold(name, mdnsService) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+		case strings.EqualFold(name, instance) && (q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeALL):
+		default:
+			continue
+		}
+		matched = append(matched, q)
+	}
+	return h.ID, matched, len(matched) > 0
+}
+
+// mdnsResponse builds a response advertising instance on port.
+func mdnsResponse(id uint16, questions []dnsmessage.Question, instance string, port int) ([]byte, error) {
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	name, err := dnsmessage.NewName(instance)
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	err = b.PTRResource(
+		dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: 120},
+		dnsmessage.PTRResource{PTR: name},
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Joining peers use the address the response came from, so the target
+	// is only a placeholder.
+	err = b.SRVResource(
+		dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 120},
+		dnsmessage.SRVResource{Port: uint16(port), Target: name},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// mdnsLookup asks the local network for the instance for slot until one
+// answers or ctx is done. It returns the address of the peer that answered.
+func mdnsLookup(ctx context.Context, slot string) (*net.TCPAddr, error) {
+	instance := mdnsInstance(slot)
+	var addr *net.TCPAddr
+	err := mdnsAsk(ctx, instance, dnsmessage.TypeSRV, func(src *net.UDPAddr, answers map[string]int) bool {
+		port := answers[strings.ToLower(instance)]
+		if port == 0 {
+			return false
+		}
+		addr = &net.TCPAddr{IP: src.IP, Port: port}
+		return true
+	})
+	return addr, err
+}
+
+// mdnsBrowse asks the local network for all the instances of the service
+// until ctx is done, and returns the slots of those that answered.
+func mdnsBrowse(ctx context.Context) (map[string]bool, error) {
+	slots := make(map[string]bool)
+	err := mdnsAsk(ctx, mdnsService, dnsmessage.TypePTR, func(src *net.UDPAddr, answers map[string]int) bool {
+		for instance := range answers {
+			if slot := strings.TrimSuffix(instance, "."+mdnsService); slot != instance {
+				slots[slot] = true
+			}
+		}
+		return false
+	})
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		err = nil
+	}
+	return slots, err
+}
+
+// mdnsAsk repeatedly asks the local network for the records of type typ of
+// name, and calls answer with the answers to each response, until it returns
+// true or ctx is done.
+func mdnsAsk(ctx context.Context, name string, typ dnsmessage.Type, answer func(src *net.UDPAddr, answers map[string]int) bool) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	query, err := mdnsQuery(name, typ)
+	if err != nil {
+		return err
+	}
+	go func() {
+		// Repeat the query in case it or its answer got lost.
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			conn.WriteToUDP(query, mdnsAddr)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		answers, ok := mdnsAnswers(buf[:n])
+		if ok && answer(src, answers) {
+			return nil
+		}
+	}
+}
+
+// mdnsAnswers parses response msg, and returns the names of the instances
+// it advertises, in lower case, with their ports. Instances without a SRV
+// record in it have port 0.
+func mdnsAnswers(msg []byte) (map[string]int, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || !h.Response {
+		return nil, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, false
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, false
+	}
+	instances := make(map[string]int)
+	for _, a := range answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if !strings.EqualFold(a.Header.Name.String(), mdnsService) {
+				continue
+			}
+			name := strings.ToLower(body.PTR.String())
+			if _, ok := instances[name]; !ok {
+				instances[name] = 0
+			}
+		case *dnsmessage.SRVResource:
+			instances[strings.ToLower(a.Header.Name.String())] = int(body.Port)
+		}
+	}
+	return instances, true
+}
+
+// mdnsQuery builds a query for the records of type typ of name.
+func mdnsQuery(name string, typ dnsmessage.Type) ([]byte, error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	var id [2]byte
+	if _, err := crand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:])})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	err = b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMDNSMatch(t *testing.T) {
+	instance := mdnsInstance("112")
+	cases := []struct {
+		name  string
+		typ   dnsmessage.Type
+		match bool
+	}{
+		{instance, dnsmessage.TypeSRV, true},
+		{instance, dnsmessage.TypeALL, true},
+		{"112._WebWormhole._tcp.local.", dnsmessage.TypeSRV, true},
+		{mdnsService, dnsmessage.TypePTR, true},
+		{instance, dnsmessage.TypeA, false},
+		{mdnsInstance("113"), dnsmessage.TypeSRV, false},
+		{"_other._tcp.local.", dnsmessage.TypePTR, false},
+	}
+	for _, c := range cases {
+		query, err := mdnsQuery(c.name, c.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, matched, ok := mdnsMatch(query, instance)
+		if ok != c.match {
+			t.Errorf("%v %v: got match %v want %v", c.name, c.typ, ok, c.match)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != h.ID {
+			t.Errorf("%v %v: got ID %v want %v", c.name, c.typ, id, h.ID)
+		}
+		if len(matched) != 1 || matched[0].Name.String() != c.name || matched[0].Type != c.typ {
+			t.Errorf("%v %v: got questions %v", c.name, c.typ, matched)
+		}
+	}
+
+	resp, err := mdnsResponse(1, nil, instance, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{resp, nil, []byte("garbage")} {
+		if _, _, ok := mdnsMatch(msg, instance); ok {
+			t.Errorf("matched %q as a query", msg)
+		}
+	}
+}
+
+func TestMDNSAnswers(t *testing.T) {
+	instance := mdnsInstance("112")
+	query, err := mdnsQuery(instance, dnsmessage.TypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, questions, _ := mdnsMatch(query, instance)
+	resp, err := mdnsResponse(1, questions, instance, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers, ok := mdnsAnswers(resp)
+	if !ok {
+		t.Fatalf("could not parse response")
+	}
+	if len(answers) != 1 || answers[instance] != 1234 {
+		t.Errorf("got answers %v want %v on port 1234", answers, instance)
+	}
+
+	for _, msg := range [][]byte{query, nil, []byte("garbage")} {
+		if _, ok := mdnsAnswers(msg); ok {
+			t.Errorf("parsed %q as a response", msg)
+		}
+	}
+}
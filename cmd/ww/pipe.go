@@ -23,24 +23,33 @@ func pipe(args ...string) {
 		os.Exit(2)
 	}
 	c := newConn(set.Arg(0), *length)
+	// Keep the terminal for the data if that's where it's going.
+	out := msgs
+	if isTerminal(os.Stdout) {
+		out = io.Discard
+	}
+	p := newProgress(c, out, isTerminal(os.Stderr))
 
 	done := make(chan struct{})
 	// The recieve end of the pipe.
 	go func() {
-		_, err := io.CopyBuffer(os.Stdout, c, make([]byte, msgChunkSize))
+		n, err := p.copy(os.Stdout, c, "stdout", "received", -1, 0)
 		if err != nil {
 			fatalf("could not write to stdout: %v", err)
 		}
+		emitFinish("stdout", n, -1, nil)
 		done <- struct{}{}
 	}()
 	// The send end of the pipe.
 	go func() {
-		_, err := io.CopyBuffer(c, os.Stdin, make([]byte, msgChunkSize))
+		n, err := p.copy(c, os.Stdin, "stdin", "sent", -1, 0)
 		if err != nil {
 			fatalf("could not write to channel: %v", err)
 		}
+		emitFinish("stdin", n, -1, nil)
 		done <- struct{}{}
 	}()
 	<-done
+	p.clear()
 	c.Close()
 }
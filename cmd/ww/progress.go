@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"webwormhole.io/wormhole"
+)
+
+const (
+	// progressInterval is how often progress is redrawn on a terminal.
+	progressInterval = 200 * time.Millisecond
+
+	// progressLogInterval is how often progress is logged when not on a
+	// terminal.
+	progressLogInterval = 5 * time.Second
+
+	// progressEventInterval is how often progress events are emitted with
+	// -json.
+	progressEventInterval = time.Second
+
+	// progressBarWidth is the width of progress bars, in characters.
+	progressBarWidth = 20
+)
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progress reports how transfers over a wormhole are going. On a terminal it
+// keeps a status line with bars for the transfers in flight up to date.
+// Otherwise it logs a line for each of them every so often, meant to be read
+// by programs. With -json, it emits events instead.
+type progress struct {
+	out   io.Writer
+	tty   bool
+	route string
+
+	mu   sync.Mutex
+	bars []*bar
+	last time.Time
+
+	// The size of, and bytes done of, all the files to be transferred, if
+	// known.
+	total     int64
+	totalDone int64
+}
+
+func newProgress(c *wormhole.Wormhole, out io.Writer, tty bool) *progress {
+	route := "direct"
+	if c.IsRelay() {
+		route = "relay"
+	}
+	return &progress{out: out, tty: tty, route: route}
+}
+
+// addTotal adds n bytes to the size of all the files to be transferred.
+func (p *progress) addTotal(n int64) {
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// skip counts n bytes that will not be transferred as done.
+func (p *progress) skip(n int64) {
+	p.mu.Lock()
+	p.totalDone += n
+	p.mu.Unlock()
+}
+
+// copy is io.CopyBuffer, showing progress as the transfer of name called
+// label. size is what the transfer will amount to, counting offset bytes
+// already done, or -1 if it's not known. Transfers of known size get a line
+// saying they're done once they are.
+func (p *progress) copy(dst io.Writer, src io.Reader, name, label string, size, offset int64) (int64, error) {
+	emit(fileEvent{Event: eventFileStart, Name: name, Bytes: offset, Size: size, Offset: offset})
+	b := &bar{
+		p:      p,
+		name:   name,
+		label:  label,
+		size:   size,
+		offset: offset,
+		done:   offset,
+		start:  time.Now(),
+	}
+	p.mu.Lock()
+	p.bars = append(p.bars, b)
+	if size >= 0 {
+		p.totalDone += offset
+	}
+	p.draw(true)
+	p.mu.Unlock()
+
+	n, err := io.CopyBuffer(&progressWriter{dst, b}, src, make([]byte, msgChunkSize))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.bars {
+		if p.bars[i] == b {
+			p.bars = append(p.bars[:i], p.bars[i+1:]...)
+			break
+		}
+	}
+	if p.tty {
+		fmt.Fprintf(p.out, "\r\x1b[K")
+	}
+	if err == nil && size >= 0 {
+		fmt.Fprintf(p.out, "%s... done\n", label)
+	}
+	if err == nil {
+		p.draw(true)
+	}
+	return n, err
+}
+
+// clear removes the status line from the terminal.
+func (p *progress) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bars = nil
+	if p.tty {
+		fmt.Fprintf(p.out, "\r\x1b[K")
+	}
+}
+
+// draw shows the progress of the transfers in flight, if it's been long
+// enough since it was last shown or force is set. p.mu must be held.
+func (p *progress) draw(force bool) {
+	interval := progressInterval
+	switch {
+	case jsonOutput:
+		interval = progressEventInterval
+	case !p.tty:
+		interval = progressLogInterval
+	}
+	now := time.Now()
+	if !force && now.Sub(p.last) < interval {
+		return
+	}
+	p.last = now
+	if len(p.bars) == 0 {
+		return
+	}
+
+	if jsonOutput {
+		if force {
+			return
+		}
+		for _, b := range p.bars {
+			emit(fileEvent{
+				Event:  eventFileProgress,
+				Name:   b.name,
+				Bytes:  b.done,
+				Size:   b.size,
+				Offset: b.offset,
+				Rate:   int64(b.rate()),
+			})
+		}
+		return
+	}
+	if !p.tty {
+		if force {
+			// Only log once there is some progress to speak of.
+			return
+		}
+		for _, b := range p.bars {
+			fmt.Fprintf(p.out, "progress label=%q bytes=%d size=%d rate=%d eta=%d route=%s",
+				b.label, b.done, b.size, int64(b.rate()), int64(b.eta().Seconds()), p.route)
+			if p.total > 0 {
+				fmt.Fprintf(p.out, " total_bytes=%d total_size=%d", p.totalDone, p.total)
+			}
+			fmt.Fprintf(p.out, "\n")
+		}
+		return
+	}
+
+	var line []string
+	for _, b := range p.bars {
+		line = append(line, b.String())
+	}
+	if p.total > 0 {
+		line = append(line, fmt.Sprintf("total %s/%s", humanSize(p.totalDone), humanSize(p.total)))
+	}
+	line = append(line, p.route)
+	fmt.Fprintf(p.out, "\r\x1b[K%s", strings.Join(line, " | "))
+}
+
+// bar is the progress of one transfer.
+type bar struct {
+	p      *progress
+	name   string
+	label  string
+	size   int64
+	offset int64
+	done   int64
+	start  time.Time
+}
+
+// rate returns the bytes per second transferred so far.
+func (b *bar) rate() float64 {
+	elapsed := time.Since(b.start).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(b.done-b.offset) / elapsed
+}
+
+// eta returns how long the transfer is likely to take to finish, or 0 if
+// there's no telling.
+func (b *bar) eta() time.Duration {
+	rate := b.rate()
+	if b.size < 0 || rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(b.size-b.done) / rate * float64(time.Second)).Round(time.Second)
+}
+
+func (b *bar) String() string {
+	rate := humanSize(int64(b.rate())) + "/s"
+	if b.size < 0 {
+		return fmt.Sprintf("%s %s %s", b.label, humanSize(b.done), rate)
+	}
+	frac := 1.0
+	if b.size > 0 {
+		frac = float64(b.done) / float64(b.size)
+	}
+	full := int(frac * progressBarWidth)
+	graph := strings.Repeat("=", full)
+	if full < progressBarWidth {
+		graph += ">" + strings.Repeat(" ", progressBarWidth-full-1)
+	}
+	s := fmt.Sprintf("%s [%s] %3.0f%% %s", b.label, graph, frac*100, rate)
+	if eta := b.eta(); eta > 0 {
+		s += " ETA " + eta.String()
+	}
+	return s
+}
+
+// progressWriter counts the bytes written through it towards a bar.
+type progressWriter struct {
+	w io.Writer
+	b *bar
+}
+
+func (w *progressWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	p := w.b.p
+	p.mu.Lock()
+	w.b.done += int64(n)
+	if w.b.size >= 0 {
+		p.totalDone += int64(n)
+	}
+	p.draw(false)
+	p.mu.Unlock()
+	return n, err
+}
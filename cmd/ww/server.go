@@ -1,38 +1,35 @@
 package main
 
-// This is the signalling server. It relays messages between peers wishing to connect.
+// This is the signalling server, with the web interface. The signalling
+// itself is in package signal.
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha1"
+	"crypto/rand"
 	"crypto/tls"
-	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
-	"strconv"
+	ossignal "os/signal"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	webrtc "github.com/pion/webrtc/v3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/acme/autocert"
-	"nhooyr.io/websocket"
-	"webwormhole.io/wormhole"
+	"webwormhole.io/relay"
+	"webwormhole.io/signal"
 )
 
-// slotTimeout is the the maximum amount of time a client is allowed to
-// hold a slot.
-const slotTimeout = 12 * time.Hour
-
 const importMeta = `<!doctype html>
 <meta charset=utf-8>
 <meta name="go-import" content="webwormhole.io git https://github.com/saljam/webwormhole">
@@ -51,285 +48,7 @@ but claims it does. Try a different web browser, and if that doesn't
 work, please file a bug report.
 `
 
-var (
-	rendezvousCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "ww",
-			Name:      "rendezvous_attempts",
-			Help:      "Number of attempts to rendezvous using the signalling server.",
-		},
-		[]string{"result"},
-	)
-	iceCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "ww",
-			Name:      "webrtc_attempts",
-			Help:      "Number of reported ICE results sliced by ICE method used.",
-		},
-		[]string{"result", "method"},
-	)
-	protocolErrorCounter = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "ww",
-			Name:      "protocol_errors",
-			Help:      "Number of bad requests to the signalling server.",
-		},
-		[]string{"kind"},
-	)
-	slotsGuage = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Namespace: "ww",
-			Name:      "busy_slots",
-			Help:      "Number of currently busy slots.",
-		},
-	)
-)
-
-func init() {
-	prometheus.MustRegister(rendezvousCounter)
-	prometheus.MustRegister(iceCounter)
-	prometheus.MustRegister(protocolErrorCounter)
-	prometheus.MustRegister(slotsGuage)
-}
-
-// slots is a map of allocated slot numbers.
-var slots = struct {
-	m map[string]chan *websocket.Conn
-	sync.RWMutex
-}{m: make(map[string]chan *websocket.Conn)}
-
-// turnSecret, turnServer, and stunServers are used to generate ICE config
-// and send it to clients as soon as they connect.
-var turnSecret string
-var turnServer string
-var stunServers []webrtc.ICEServer
-
-// freeslot tries to find an available numeric slot, favouring smaller numbers.
-// This assume slots is locked.
-func freeslot() (slot string, ok bool) {
-	// Assuming varint encoding, we first try for one byte. That's 7 bits in varint.
-	for i := 0; i < 64; i++ {
-		s := strconv.Itoa(rand.Intn(1 << 7))
-		if _, ok := slots.m[s]; !ok {
-			return s, true
-		}
-	}
-	// Then try for two bytes. 11 bits.
-	for i := 0; i < 1024; i++ {
-		s := strconv.Itoa(rand.Intn(1 << 11))
-		if _, ok := slots.m[s]; !ok {
-			return s, true
-		}
-	}
-	// Then try for three bytes. 16 bits.
-	for i := 0; i < 2048; i++ {
-		s := strconv.Itoa(rand.Intn(1 << 16))
-		if _, ok := slots.m[s]; !ok {
-			return s, true
-		}
-	}
-	// Then try for four bytes. 21 bits.
-	for i := 0; i < 2048; i++ {
-		s := strconv.Itoa(rand.Intn(1 << 21))
-		if _, ok := slots.m[s]; !ok {
-			return s, true
-		}
-	}
-	// Give up.
-	return "", false
-}
-
-// turnServers return the configured TURN server with HMAC-based ephemeral
-// credentials generated as described in:
-// https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
-func turnServers() []webrtc.ICEServer {
-	if turnServer == "" {
-		return nil
-	}
-	username := fmt.Sprintf("%d:wormhole", time.Now().Add(slotTimeout).Unix())
-	mac := hmac.New(sha1.New, []byte(turnSecret))
-	mac.Write([]byte(username))
-	return []webrtc.ICEServer{{
-		URLs:       []string{turnServer},
-		Username:   username,
-		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
-	}}
-}
-
-// relay sets up a rendezvous on a slot and pipes the two websockets together.
-func relay(w http.ResponseWriter, r *http.Request) {
-	slotkey := r.URL.Path[1:] // strip leading slash
-	var rconn *websocket.Conn
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		// This sounds nasty but checking origin only matters if requests
-		// change any user state on the server, aka CSRF. We don't have any
-		// user state other than this ephemeral connection. So it's fine.
-		InsecureSkipVerify: true,
-
-		// Safari has broken compression.
-		// https://github.com/nhooyr/websocket/issues/218
-		CompressionMode: websocket.CompressionDisabled,
-
-		// Protocol version negotiation.
-		Subprotocols: []string{wormhole.Protocol},
-	})
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	if conn.Subprotocol() != wormhole.Protocol {
-		// Make sure we negotiated the right protocol, since "blank" is also a
-		// default one.
-		protocolErrorCounter.WithLabelValues("wrongversion").Inc()
-		conn.Close(wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(r.Context(), slotTimeout)
-
-	initmsg := struct {
-		Slot       string             `json:"slot",omitempty`
-		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
-	}{}
-	initmsg.ICEServers = append(turnServers(), stunServers...)
-
-	go func() {
-		if slotkey == "" {
-			// Book a new slot.
-			slots.Lock()
-			newslot, ok := freeslot()
-			if !ok {
-				slots.Unlock()
-				rendezvousCounter.WithLabelValues("nomoreslots").Inc()
-				conn.Close(wormhole.CloseNoMoreSlots, "cannot allocate slots")
-				return
-			}
-			slotkey = newslot
-			sc := make(chan *websocket.Conn)
-			slots.m[slotkey] = sc
-			slotsGuage.Set(float64(len(slots.m)))
-			slots.Unlock()
-			initmsg.Slot = slotkey
-			buf, err := json.Marshal(initmsg)
-			if err != nil {
-				log.Println(err)
-				slots.Lock()
-				delete(slots.m, slotkey)
-				slotsGuage.Set(float64(len(slots.m)))
-				slots.Unlock()
-				return
-			}
-			err = conn.Write(ctx, websocket.MessageText, buf)
-			if err != nil {
-				log.Println(err)
-				slots.Lock()
-				delete(slots.m, slotkey)
-				slotsGuage.Set(float64(len(slots.m)))
-				slots.Unlock()
-				return
-			}
-
-		wait:
-			for {
-				select {
-				case <-ctx.Done():
-					rendezvousCounter.WithLabelValues("timeout").Inc()
-					slots.Lock()
-					delete(slots.m, slotkey)
-					slotsGuage.Set(float64(len(slots.m)))
-					slots.Unlock()
-					conn.Close(wormhole.CloseSlotTimedOut, "timed out")
-					return
-				case <-time.After(30 * time.Second):
-					// Do a WebSocket Ping every 30 seconds.
-					conn.Ping(ctx)
-				case sc <- conn:
-					break wait
-				}
-			}
-			rconn = <-sc
-			rendezvousCounter.WithLabelValues("success").Inc()
-			return
-		}
-
-		// Join an existing slot.
-		slots.Lock()
-		sc, ok := slots.m[slotkey]
-		if !ok {
-			slots.Unlock()
-			rendezvousCounter.WithLabelValues("nosuchslot").Inc()
-			conn.Close(wormhole.CloseNoSuchSlot, "no such slot")
-			return
-		}
-		delete(slots.m, slotkey)
-		slotsGuage.Set(float64(len(slots.m)))
-		slots.Unlock()
-		initmsg.Slot = slotkey
-		buf, err := json.Marshal(initmsg)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		err = conn.Write(ctx, websocket.MessageText, buf)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		select {
-		case <-ctx.Done():
-			conn.Close(wormhole.CloseSlotTimedOut, "timed out")
-		case rconn = <-sc:
-		}
-		sc <- conn
-		rendezvousCounter.WithLabelValues("success").Inc()
-	}()
-
-	defer cancel()
-	for {
-		msgType, p, err := conn.Read(ctx)
-		switch websocket.CloseStatus(err) {
-		case wormhole.CloseBadKey:
-			iceCounter.WithLabelValues("fail", "badkey").Inc()
-			if rconn != nil {
-				rconn.Close(wormhole.CloseBadKey, "bad key")
-			}
-			return
-		case wormhole.CloseWebRTCFailed:
-			iceCounter.WithLabelValues("fail", "unknown").Inc()
-			return
-		case wormhole.CloseWebRTCSuccess:
-			iceCounter.WithLabelValues("success", "unknown").Inc()
-			return
-		case wormhole.CloseWebRTCSuccessDirect:
-			iceCounter.WithLabelValues("success", "direct").Inc()
-			return
-		case wormhole.CloseWebRTCSuccessRelay:
-			iceCounter.WithLabelValues("success", "relay").Inc()
-			return
-		}
-		if err != nil {
-			iceCounter.WithLabelValues("unknown", "unknown").Inc()
-			if rconn != nil {
-				rconn.Close(wormhole.ClosePeerHungUp, "peer hung up")
-			}
-			return
-		}
-		if rconn == nil {
-			// We could synchronise with the rendezvous goroutine above and wait for
-			// B to connect, but receiving anything at this stage is a protocol violation
-			// so we should just bail out.
-			return
-		}
-		err = rconn.Write(ctx, msgType, p)
-		if err != nil {
-			return
-		}
-	}
-}
-
 func server(args ...string) {
-	rand.Seed(time.Now().UnixNano()) // for slot allocation
-
 	set := flag.NewFlagSet(args[0], flag.ExitOnError)
 	set.Usage = func() {
 		fmt.Fprintf(set.Output(), "run the webwormhole signalling server\n\n")
@@ -346,30 +65,113 @@ func server(args ...string) {
 	key := set.String("key", "", "https certificate key")
 	html := set.String("ui", "./web", "path to the web interface files")
 	stunservers := set.String("stun", "stun:relay.webwormhole.io", "list of STUN server addresses to tell clients to use")
-	set.StringVar(&turnServer, "turn", "", "TURN server to use for relaying")
-	set.StringVar(&turnSecret, "turn-secret", "", "secret for HMAC-based authentication in TURN server")
+	drain := set.Duration("drain", time.Minute, "how long to let peers that have met finish signalling when shutting down")
+	turnServer := set.String("turn", "", "TURN server to use for relaying")
+	turnSecret := set.String("turn-secret", "", "secret for HMAC-based authentication in TURN server")
+	relayaddr := set.String("relay", "", "address to run a TURN relay on, e.g. :3478, to use instead of -turn")
+	relayIP := set.String("relay-ip", "", "public IP address of the relay")
+	relayBandwidth := set.Int("relay-bandwidth", 1<<20, "bytes a second each relayed connection may use, or 0 for no limit")
+	relayQuota := set.Int64("relay-quota", 1<<30, "bytes each relayed connection may use in all, or 0 for no limit")
+	relayAllocations := set.Int("relay-allocations", 1000, "how many relayed connections there may be at once, or 0 for no limit")
+	redisURL := set.String("redis", "", "URL of a Redis server to share slots with other signalling servers through")
+	bookRate := set.Float64("book-rate", 0, "slots a client may book a minute, or 0 for no limit. Clients are told apart by their addresses, so behind a proxy set -trusted-proxies too")
+	joinRate := set.Float64("join-rate", 0, "slots a client may try to join a minute, or 0 for no limit. Clients are told apart by their addresses, so behind a proxy set -trusted-proxies too")
+	burst := set.Int("burst", 10, "slots a client may book, or try to join, in a row before -book-rate or -join-rate apply")
+	ban := set.Duration("ban", 10*time.Minute, "how long to turn away clients that go over -book-rate or -join-rate")
+	ipv4Prefix := set.Int("ipv4-prefix", 32, "length of the IPv4 subnets clients are limited by")
+	ipv6Prefix := set.Int("ipv6-prefix", 64, "length of the IPv6 subnets clients are limited by")
+	trustedProxies := set.String("trusted-proxies", "", "comma separated list of addresses or subnets of proxies to take clients' addresses from the X-Forwarded-For header of")
 	set.Parse(args[1:])
 
 	if (*cert == "") != (*key == "") {
 		log.Fatalf("-cert and -key options must be provided together or both left empty")
 	}
 
-	if turnServer != "" && turnSecret == "" {
-		log.Fatal("cannot use a TURN server without a secret")
+	var relayserv *relay.Server
+	if *relayaddr != "" {
+		ip := net.ParseIP(*relayIP)
+		if ip == nil {
+			log.Fatalf("-relay needs the relay's public IP address in -relay-ip")
+		}
+		if *turnSecret == "" {
+			// Nobody else needs to know it.
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				log.Fatal(err)
+			}
+			*turnSecret = hex.EncodeToString(buf)
+		}
+		conn, err := net.ListenPacket("udp", *relayaddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		relayserv, err = relay.NewServer(conn, &relay.Config{
+			Secret:         *turnSecret,
+			RelayIP:        ip,
+			Bandwidth:      *relayBandwidth,
+			Quota:          *relayQuota,
+			MaxAllocations: *relayAllocations,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *turnServer == "" {
+			_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+			*turnServer = "turn:" + net.JoinHostPort(ip.String(), port)
+		}
 	}
 
+	cfg := &signal.Config{
+		TURNServer: *turnServer,
+		TURNSecret: *turnSecret,
+		IPv4Prefix: *ipv4Prefix,
+		IPv6Prefix: *ipv6Prefix,
+	}
+	for _, p := range strings.Split(*trustedProxies, ",") {
+		if p == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if !strings.Contains(p, "/") {
+			// A single address.
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(p)
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		if err != nil {
+			log.Fatalf("invalid -trusted-proxies: %v", err)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, prefix.Masked())
+	}
+	if *bookRate != 0 {
+		cfg.BookLimit = signal.Limit{Rate: *bookRate / 60, Burst: *burst, Ban: *ban}
+	}
+	if *joinRate != 0 {
+		cfg.JoinLimit = signal.Limit{Rate: *joinRate / 60, Burst: *burst, Ban: *ban}
+	}
 	for _, s := range strings.Split(*stunservers, ",") {
 		if s == "" {
 			continue
 		}
-		stunServers = append(stunServers, webrtc.ICEServer{URLs: []string{s}})
+		cfg.ICEServers = append(cfg.ICEServers, webrtc.ICEServer{URLs: []string{s}})
+	}
+	if *redisURL != "" {
+		opts, err := redis.ParseURL(*redisURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Store = signal.NewRedisStore(redis.NewClient(opts))
+	}
+	sigserv, err := signal.NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	fs := gziphandler.GzipHandler(http.FileServer(http.Dir(*html)))
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		// Handle WebSocket connections.
 		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
-			relay(w, r)
+			sigserv.ServeHTTP(w, r)
 			return
 		}
 
@@ -405,7 +207,7 @@ func server(args ...string) {
 		// Handle the Service Worker private prefix. A well-behaved Service Worker
 		// must *never* reach us on this path.
 		if strings.HasPrefix(r.URL.Path, "/_/") {
-			protocolErrorCounter.WithLabelValues("serviceworkererr").Inc()
+			sigserv.ProtocolError("serviceworkererr")
 			http.Error(w, serviceWorkerPage, http.StatusNotFound)
 			return
 		}
@@ -451,7 +253,14 @@ func server(args ...string) {
 
 	errc := make(chan error)
 	if *debugaddr != "" {
-		http.Handle("/metrics", promhttp.Handler())
+		gatherers := prometheus.Gatherers{
+			prometheus.DefaultGatherer,
+			sigserv.Registry(),
+		}
+		if relayserv != nil {
+			gatherers = append(gatherers, relayserv.Registry())
+		}
+		http.Handle("/metrics", promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
 		go func() { errc <- http.ListenAndServe(*debugaddr, nil) }()
 	}
 	if *httpsaddr != "" {
@@ -461,5 +270,27 @@ func server(args ...string) {
 	if *httpaddr != "" {
 		go func() { errc <- srv.ListenAndServe() }()
 	}
-	log.Fatal(<-errc)
+
+	// On SIGTERM, turn new peers away and let the ones that have met
+	// finish, then stop.
+	sigc := make(chan os.Signal, 1)
+	ossignal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		log.Fatal(err)
+	case sig := <-sigc:
+		log.Printf("got %v, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *drain)
+	defer cancel()
+	if err := sigserv.Shutdown(ctx); err != nil {
+		log.Printf("gave up waiting for peers to finish signalling: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ssrv.Shutdown(ctx)
+	srv.Shutdown(ctx)
+	if relayserv != nil {
+		relayserv.Close()
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+// Files whose size isn't known upfront, like what ww send reads from stdin,
+// are sent as streams, if the receiver supports them. The header of a stream
+// has Stream set and no size. Each message of its data starts with a byte
+// saying whether it carries data or marks the end of the stream, and any
+// trailer follows the end marker.
+
+import (
+	"errors"
+	"io"
+)
+
+// Flags at the start of each message of a stream.
+const (
+	frameEnd  = 0
+	frameData = 1
+)
+
+// frameWriter writes each Write to an underlying writer as a data message of
+// a stream.
+type frameWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.buf = append(append(w.buf[:0], frameData), p...)
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the end marker.
+func (w *frameWriter) Close() error {
+	_, err := w.w.Write([]byte{frameEnd})
+	return err
+}
+
+// frameReader reads the data of a stream from an underlying reader, a message
+// per Read. It returns io.EOF once it reads the end marker.
+type frameReader struct {
+	r    io.Reader
+	msg  []byte
+	data []byte
+	done bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.msg == nil {
+			r.msg = make([]byte, maxMsgSize)
+		}
+		n, err := r.r.Read(r.msg)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, errors.New("empty message in stream")
+		}
+		switch r.msg[0] {
+		case frameEnd:
+			r.done = true
+		case frameData:
+			r.data = r.msg[1:n]
+		default:
+			return 0, errors.New("unknown message in stream")
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// messages is a queue of messages, read back one per Read like from a
+// wormhole.
+type messages [][]byte
+
+func (m *messages) Write(p []byte) (int, error) {
+	*m = append(*m, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (m *messages) Read(p []byte) (int, error) {
+	if len(*m) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*m)[0])
+	*m = (*m)[1:]
+	return n, nil
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), maxMsgSize-1)
+	for _, writes := range [][][]byte{
+		nil,
+		{[]byte("hello")},
+		// Empty writes don't end the stream.
+		{nil, []byte("hello"), {}, []byte(" world")},
+		{big, big},
+	} {
+		var m messages
+		w := &frameWriter{w: &m}
+		var want []byte
+		for _, p := range writes {
+			if n, err := w.Write(p); n != len(p) || err != nil {
+				t.Fatalf("wrote %d of %d bytes: %v", n, len(p), err)
+			}
+			want = append(want, p...)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != len(writes)+1 {
+			t.Errorf("wrote %d messages, want one per write and the end marker", len(m))
+		}
+
+		// Something after the stream must be left for the next reader.
+		m.Write([]byte("trailer"))
+		got, err := io.ReadAll(&frameReader{r: &m})
+		if err != nil {
+			t.Fatalf("could not read stream: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %d bytes back, want %d", len(got), len(want))
+		}
+		if len(m) != 1 || string(m[0]) != "trailer" {
+			t.Errorf("reader left %q, want the trailer", m)
+		}
+	}
+}
+
+func TestFrameMalformed(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		msgs messages
+		// data is what is read before the error.
+		data string
+		want error
+	}{
+		{"truncated", messages{{frameData, 'a'}}, "a", io.ErrUnexpectedEOF},
+		{"nothing", messages{}, "", io.ErrUnexpectedEOF},
+		{"empty message", messages{{frameData, 'a'}, {}}, "a", nil},
+		{"unknown flag", messages{{frameData, 'a'}, {2, 'b'}}, "a", nil},
+	} {
+		got, err := io.ReadAll(&frameReader{r: &c.msgs})
+		if err == nil {
+			t.Errorf("%s: read %q without an error", c.name, got)
+			continue
+		}
+		if c.want != nil && err != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		if string(got) != c.data {
+			t.Errorf("%s: read %q before the error, want %q", c.name, got, c.data)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Package compress compresses file data sent over a wormhole, a message at a
+// time.
+//
+// Each message of a compressed file starts with a byte saying whether the
+// rest of it is compressed or raw. Messages are compressed independently of
+// each other, so each one can be decoded on its own as it arrives, and blocks
+// that don't get any smaller are sent raw.
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression schemes.
+const (
+	Zstd    = "zstd"
+	Deflate = "deflate"
+)
+
+// Schemes lists the supported compression schemes, most preferred first.
+var Schemes = []string{Zstd, Deflate}
+
+// BlockSize is the most data a message holds before compression.
+const BlockSize = 32 << 10
+
+// Flags at the start of each message.
+const (
+	flagRaw        = 0
+	flagCompressed = 1
+)
+
+var (
+	// ErrUnknownScheme is returned for compression schemes not in Schemes.
+	ErrUnknownScheme = errors.New("unknown compression scheme")
+
+	// ErrBlockTooLarge is returned for messages that decode to more than
+	// BlockSize bytes.
+	ErrBlockTooLarge = errors.New("block too large")
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil,
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithWindowSize(BlockSize),
+	)
+	zstdDecoder, _ = zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(BlockSize),
+	)
+
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+)
+
+// Supported reports whether scheme is one of Schemes.
+func Supported(scheme string) bool {
+	for _, s := range Schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// Compressible reports whether data of MIME type typ is worth compressing.
+// Most image, audio and video formats, and archives, are compressed already.
+func Compressible(typ string) bool {
+	typ = strings.ToLower(strings.TrimSpace(strings.Split(typ, ";")[0]))
+	switch typ {
+	case "image/svg+xml", "image/bmp", "image/x-ms-bmp", "image/tiff",
+		"audio/wav", "audio/x-wav", "audio/wave":
+		return true
+	case "application/zip", "application/gzip", "application/x-gzip",
+		"application/x-bzip2", "application/x-xz", "application/zstd",
+		"application/x-7z-compressed", "application/vnd.rar",
+		"application/x-rar-compressed", "application/java-archive",
+		"application/epub+zip", "application/pdf", "application/x-compress",
+		"font/woff", "font/woff2":
+		return false
+	}
+	for _, prefix := range []string{
+		"image/", "audio/", "video/",
+		"application/vnd.openxmlformats-officedocument.",
+		"application/vnd.oasis.opendocument.",
+	} {
+		if strings.HasPrefix(typ, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode returns the message carrying block, compressed with scheme unless
+// that doesn't make it smaller. block must be at most BlockSize bytes.
+func Encode(scheme string, block []byte) ([]byte, error) {
+	if len(block) > BlockSize {
+		return nil, ErrBlockTooLarge
+	}
+	msg := []byte{flagCompressed}
+	switch scheme {
+	case Zstd:
+		msg = zstdEncoder.EncodeAll(block, msg)
+	case Deflate:
+		buf := bytes.NewBuffer(msg)
+		w := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(w)
+		w.Reset(buf)
+		if _, err := w.Write(block); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		msg = buf.Bytes()
+	default:
+		return nil, ErrUnknownScheme
+	}
+	if len(msg) > len(block) {
+		msg = append(msg[:0], flagRaw)
+		msg = append(msg, block...)
+	}
+	return msg, nil
+}
+
+// Decode returns the block carried by msg, a message made by Encode with
+// scheme.
+func Decode(scheme string, msg []byte) ([]byte, error) {
+	if !Supported(scheme) {
+		return nil, ErrUnknownScheme
+	}
+	if len(msg) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch msg[0] {
+	case flagRaw:
+		if len(msg)-1 > BlockSize {
+			return nil, ErrBlockTooLarge
+		}
+		return msg[1:], nil
+	case flagCompressed:
+	default:
+		return nil, fmt.Errorf("unknown block flag %d", msg[0])
+	}
+	if scheme == Zstd {
+		block, err := zstdDecoder.DecodeAll(msg[1:], nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrBlockTooLarge
+		}
+		return block, err
+	}
+	r := flate.NewReader(bytes.NewReader(msg[1:]))
+	defer r.Close()
+	block, err := io.ReadAll(io.LimitReader(r, BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(block) > BlockSize {
+		return nil, ErrBlockTooLarge
+	}
+	return block, nil
+}
+
+// Writer compresses what is written to it into messages on an underlying
+// writer, one for every BlockSize bytes or less.
+type Writer struct {
+	w      io.Writer
+	scheme string
+}
+
+// NewWriter returns a Writer that compresses with scheme and writes messages
+// to w.
+func NewWriter(w io.Writer, scheme string) (*Writer, error) {
+	if !Supported(scheme) {
+		return nil, ErrUnknownScheme
+	}
+	return &Writer{w: w, scheme: scheme}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		block := p
+		if len(block) > BlockSize {
+			block = block[:BlockSize]
+		}
+		msg, err := Encode(w.scheme, block)
+		if err != nil {
+			return n, err
+		}
+		if _, err := w.w.Write(msg); err != nil {
+			return n, err
+		}
+		n += len(block)
+		p = p[len(block):]
+	}
+	return n, nil
+}
+
+// Reader decompresses messages read from an underlying reader.
+type Reader struct {
+	r      io.Reader
+	scheme string
+	left   int64
+	msg    []byte
+	block  []byte
+}
+
+// NewReader returns a Reader of the n bytes sent compressed with scheme on r.
+// Each Read from r must return a whole message, like those from a
+// wormhole.Wormhole do. It reads no further than the message with the last of
+// the n bytes.
+func NewReader(r io.Reader, scheme string, n int64) (*Reader, error) {
+	if !Supported(scheme) {
+		return nil, ErrUnknownScheme
+	}
+	return &Reader{
+		r:      r,
+		scheme: scheme,
+		left:   n,
+		// Raw messages are a byte longer than the block they carry.
+		msg: make([]byte, 2*BlockSize),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.block) == 0 {
+		if r.left <= 0 {
+			return 0, io.EOF
+		}
+		n, err := r.r.Read(r.msg)
+		if err != nil {
+			return 0, err
+		}
+		block, err := Decode(r.scheme, r.msg[:n])
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(block)) > r.left {
+			return 0, errors.New("compressed data is longer than expected")
+		}
+		r.left -= int64(len(block))
+		r.block = block
+	}
+	n := copy(p, r.block)
+	r.block = r.block[n:]
+	return n, nil
+}
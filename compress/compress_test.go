@@ -0,0 +1,132 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// messages is a queue of messages, read back one per Read like from a
+// wormhole.
+type messages [][]byte
+
+func (m *messages) Write(p []byte) (int, error) {
+	*m = append(*m, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (m *messages) Read(p []byte) (int, error) {
+	if len(*m) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, (*m)[0])
+	*m = (*m)[1:]
+	return n, nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("2021/01/02 15:04:05 connected: direct\n"), 10000)
+	random := make([]byte, 3*BlockSize+17)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, scheme := range Schemes {
+		for _, data := range [][]byte{nil, []byte("a"), text, random} {
+			var m messages
+			w, err := NewWriter(&m, scheme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("%s: could not compress: %v", scheme, err)
+			}
+			sent := 0
+			for _, msg := range m {
+				sent += len(msg)
+			}
+			if bytes.Equal(data, text) && sent > len(data)/10 {
+				t.Errorf("%s: text compressed to %d of %d bytes", scheme, sent, len(data))
+			}
+			if bytes.Equal(data, random) && sent > len(data)+len(m) {
+				t.Errorf("%s: random data grew to %d from %d bytes", scheme, sent, len(data))
+			}
+
+			// Something after the data must be left for the next reader.
+			m.Write([]byte("trailer"))
+			r, err := NewReader(&m, scheme, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: could not decompress: %v", scheme, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: got %d bytes back, want %d", scheme, len(got), len(data))
+			}
+			if len(m) != 1 || string(m[0]) != "trailer" {
+				t.Errorf("%s: reader left %q, want the trailer", scheme, m)
+			}
+		}
+	}
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	zeros := make([]byte, 4*BlockSize)
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zmsg := enc.EncodeAll(zeros, []byte{flagCompressed})
+
+	var buf bytes.Buffer
+	buf.WriteByte(flagCompressed)
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(zeros)
+	fw.Close()
+
+	for scheme, msg := range map[string][]byte{Zstd: zmsg, Deflate: buf.Bytes()} {
+		if _, err := Decode(scheme, msg); !errors.Is(err, ErrBlockTooLarge) {
+			t.Errorf("%s: got error %v, want %v", scheme, err, ErrBlockTooLarge)
+		}
+	}
+}
+
+func TestUnknownScheme(t *testing.T) {
+	if _, err := NewWriter(io.Discard, "lzma"); err != ErrUnknownScheme {
+		t.Errorf("NewWriter: got error %v, want %v", err, ErrUnknownScheme)
+	}
+	if _, err := Decode("lzma", []byte{flagRaw}); err != ErrUnknownScheme {
+		t.Errorf("Decode: got error %v, want %v", err, ErrUnknownScheme)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	cases := []struct {
+		typ  string
+		want bool
+	}{
+		{"", true},
+		{"text/plain; charset=utf-8", true},
+		{"application/json", true},
+		{"image/svg+xml", true},
+		{"image/jpeg", false},
+		{"Video/MP4", false},
+		{"application/zip", false},
+		{"application/gzip", false},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", false},
+	}
+	for _, c := range cases {
+		if got := Compressible(c.typ); got != c.want {
+			t.Errorf("Compressible(%q) = %v, want %v", c.typ, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+// Package relay implements a TURN server, to relay the connections of peers
+// that can't reach each other directly. It also answers STUN requests.
+//
+// It only lets in clients with the ephemeral credentials the signalling
+// server hands out for it, made as described in
+// https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00 with a secret
+// the two share. See package signal.
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// user is the user part of the usernames of credentials, after their expiry
+// time.
+const user = "wormhole"
+
+// maxPacket is the largest packet a client sends the relay, going by
+// pion/turn's default inbound MTU. A relay's bandwidth allows at least this
+// much at once, so that no packet is too large to ever get through.
+const maxPacket = 1600
+
+// Credentials returns ephemeral credentials for a relay with secret that
+// expire at expires.
+func Credentials(secret string, expires time.Time) (username, password string) {
+	username = fmt.Sprintf("%d:%s", expires.Unix(), user)
+	return username, credential(secret, username)
+}
+
+// credential returns the password for username of a relay with secret.
+func credential(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// A Config configures a Server.
+type Config struct {
+	// Secret is the secret credentials are made with. It must be the
+	// same as the signalling server's.
+	Secret string
+
+	// RelayIP is the public IP address of the Server, which clients tell
+	// their peers to send relayed packets to.
+	RelayIP net.IP
+
+	// Realm is the TURN realm. If empty, it is "webwormhole".
+	Realm string
+
+	// Bandwidth, if not zero, is how many bytes a second each allocation
+	// may relay, both ways. Packets over it are dropped.
+	Bandwidth int
+
+	// Quota, if not zero, is how many bytes each allocation may relay in
+	// all, after which it stops relaying.
+	Quota int64
+
+	// MaxAllocations, if not zero, is how many allocations there may be at
+	// once.
+	MaxAllocations int
+
+	// allowLoopback lets peers be on the loopback interface. Tests set it
+	// to relay to peers of their own.
+	allowLoopback bool
+}
+
+// A Server is a TURN and STUN server.
+//
+// Each Server has its own metrics, in a registry of its own.
+type Server struct {
+	cfg  Config
+	turn *turn.Server
+
+	registry          *prometheus.Registry
+	allocationsGauge  prometheus.Gauge
+	bytesCounter      *prometheus.CounterVec
+	droppedCounter    prometheus.Counter
+	refusedCounter    *prometheus.CounterVec
+	peersCounter      prometheus.Counter
+	authFailedCounter *prometheus.CounterVec
+
+	// allocations is the number of allocations, kept by the relayConns.
+	allocations int64
+
+	// localIPs are the addresses of the machine the Server runs on.
+	localIPs []net.IP
+}
+
+// NewServer returns a Server configured by cfg, serving on conn until it is
+// closed.
+func NewServer(conn net.PacketConn, cfg *Config) (*Server, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("cannot run a relay without a secret")
+	}
+	if cfg.RelayIP == nil {
+		return nil, errors.New("cannot run a relay without a public IP address")
+	}
+	s := &Server{
+		cfg: *cfg,
+
+		registry: prometheus.NewRegistry(),
+		allocationsGauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "ww",
+				Subsystem: "relay",
+				Name:      "allocations",
+				Help:      "Number of current TURN allocations.",
+			},
+		),
+		bytesCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Subsystem: "relay",
+				Name:      "bytes",
+				Help:      "Number of bytes relayed, sliced by whether they were going to or coming from the peer.",
+			},
+			[]string{"direction"},
+		),
+		droppedCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Subsystem: "relay",
+				Name:      "dropped_bytes",
+				Help:      "Number of bytes dropped for going over the bandwidth of an allocation.",
+			},
+		),
+		refusedCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Subsystem: "relay",
+				Name:      "refused",
+				Help:      "Number of allocations refused or stopped, sliced by the quota they went over.",
+			},
+			[]string{"quota"},
+		),
+		peersCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Subsystem: "relay",
+				Name:      "refused_peers",
+				Help:      "Number of permissions and packets refused for peers that are not on the internet.",
+			},
+		),
+		authFailedCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Subsystem: "relay",
+				Name:      "auth_failures",
+				Help:      "Number of requests with unusable credentials.",
+			},
+			[]string{"reason"},
+		),
+	}
+	if s.cfg.Realm == "" {
+		s.cfg.Realm = "webwormhole"
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			s.localIPs = append(s.localIPs, ipnet.IP)
+		}
+	}
+	s.registry.MustRegister(
+		s.allocationsGauge,
+		s.bytesCounter,
+		s.droppedCounter,
+		s.refusedCounter,
+		s.peersCounter,
+		s.authFailedCounter,
+	)
+
+	s.turn, err = turn.NewServer(turn.ServerConfig{
+		Realm:       s.cfg.Realm,
+		AuthHandler: s.auth,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			PermissionHandler: func(clientAddr net.Addr, peerIP net.IP) bool {
+				return s.permit(peerIP)
+			},
+			RelayAddressGenerator: &relayAddressGenerator{
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: s.cfg.RelayIP,
+					Address:      "0.0.0.0",
+				},
+				s: s,
+			},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Registry returns the registry of the Server's metrics.
+func (s *Server) Registry() *prometheus.Registry {
+	return s.registry
+}
+
+// Close stops the Server, and closes its connection and all the relayed ones.
+func (s *Server) Close() error {
+	return s.turn.Close()
+}
+
+// auth returns the key for username, if it is for credentials that are ours
+// and haven't expired.
+func (s *Server) auth(username, realm string, src net.Addr) (key []byte, ok bool) {
+	expiry, u, ok := strings.Cut(username, ":")
+	if !ok || u != user {
+		s.authFailedCounter.WithLabelValues("badusername").Inc()
+		return nil, false
+	}
+	t, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		s.authFailedCounter.WithLabelValues("badusername").Inc()
+		return nil, false
+	}
+	if time.Now().After(time.Unix(t, 0)) {
+		s.authFailedCounter.WithLabelValues("expired").Inc()
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, credential(s.cfg.Secret, username)), true
+}
+
+// permit reports whether clients may relay to and from peers at ip, and
+// counts it if not. Only peers on the internet are allowed, so that clients
+// can't use the Server to reach the network it is on, or the Server itself.
+func (s *Server) permit(ip net.IP) bool {
+	if !s.public(ip) {
+		s.peersCounter.Inc()
+		return false
+	}
+	return true
+}
+
+// public reports whether ip is an address on the internet, other than the
+// Server's own.
+func (s *Server) public(ip net.IP) bool {
+	if s.cfg.allowLoopback && ip.IsLoopback() {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return false
+	}
+	if ip.Equal(s.cfg.RelayIP) {
+		return false
+	}
+	for _, local := range s.localIPs {
+		if ip.Equal(local) {
+			return false
+		}
+	}
+	return true
+}
+
+// relayAddressGenerator makes the connections of allocations count against
+// the Server's quotas.
+type relayAddressGenerator struct {
+	turn.RelayAddressGenerator
+	s *Server
+}
+
+func (g *relayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	s := g.s
+	n := atomic.AddInt64(&s.allocations, 1)
+	if s.cfg.MaxAllocations != 0 && n > int64(s.cfg.MaxAllocations) {
+		atomic.AddInt64(&s.allocations, -1)
+		s.refusedCounter.WithLabelValues("allocations").Inc()
+		return nil, nil, errors.New("too many allocations")
+	}
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		atomic.AddInt64(&s.allocations, -1)
+		return nil, nil, err
+	}
+	s.allocationsGauge.Inc()
+	rc := &relayConn{PacketConn: conn, s: s}
+	if s.cfg.Bandwidth != 0 {
+		burst := s.cfg.Bandwidth
+		if burst < maxPacket {
+			burst = maxPacket
+		}
+		rc.limiter = rate.NewLimiter(rate.Limit(s.cfg.Bandwidth), burst)
+	}
+	return rc, addr, nil
+}
+
+// relayConn is the connection of an allocation, which relays packets between
+// a client and its peers.
+type relayConn struct {
+	net.PacketConn
+	s       *Server
+	limiter *rate.Limiter
+
+	// used is how many bytes it has relayed.
+	used      int64
+	closeOnce sync.Once
+}
+
+// allow reports whether the allocation may relay n more bytes, and counts them
+// if it may. Once it has used up its quota, it closes the connection.
+func (c *relayConn) allow(n int) (bool, error) {
+	if c.limiter != nil && !c.limiter.AllowN(time.Now(), n) {
+		c.s.droppedCounter.Add(float64(n))
+		return false, nil
+	}
+	used := atomic.AddInt64(&c.used, int64(n))
+	if c.s.cfg.Quota != 0 && used > c.s.cfg.Quota {
+		if used-int64(n) <= c.s.cfg.Quota {
+			c.s.refusedCounter.WithLabelValues("bytes").Inc()
+		}
+		c.Close()
+		return false, errors.New("relay quota used up")
+	}
+	return true, nil
+}
+
+// WriteTo relays a packet from the client to a peer.
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if udp, ok := addr.(*net.UDPAddr); !ok || !c.s.permit(udp.IP) {
+		return 0, fmt.Errorf("not relaying to %v", addr)
+	}
+	ok, err := c.allow(len(p))
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		// Dropped, as if lost on the way.
+		return len(p), nil
+	}
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.s.bytesCounter.WithLabelValues("to_peer").Add(float64(n))
+	return n, err
+}
+
+// ReadFrom waits for a packet from a peer to relay to the client.
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		ok, err := c.allow(n)
+		if err != nil {
+			return 0, addr, err
+		}
+		if ok {
+			c.s.bytesCounter.WithLabelValues("from_peer").Add(float64(n))
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *relayConn) Close() error {
+	err := c.PacketConn.Close()
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.s.allocations, -1)
+		c.s.allocationsGauge.Dec()
+	})
+	return err
+}
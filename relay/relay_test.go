@@ -0,0 +1,268 @@
+package relay
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const secret = "secret"
+
+func newTestServer(t *testing.T, cfg *Config) (*Server, string) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.Secret = secret
+	cfg.RelayIP = net.IPv4(127, 0, 0, 1)
+	cfg.allowLoopback = true
+	s, err := NewServer(conn, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, conn.LocalAddr().String()
+}
+
+// newClient returns a TURN client of the server at addr using username and
+// password.
+func newClient(t *testing.T, addr, username, password string) *turn.Client {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		RTO:            100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newPeer returns a UDP socket for the other end of a relayed connection.
+func newPeer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// read reads a packet from conn, or returns nil if none comes soon.
+func read(t *testing.T, conn net.PacketConn) ([]byte, net.Addr) {
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 2*maxPacket)
+	n, addr, err := conn.ReadFrom(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil, nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n], addr
+}
+
+func TestRelay(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	username, password := Credentials(secret, time.Now().Add(time.Hour))
+	c := newClient(t, addr, username, password)
+
+	if _, err := c.SendBindingRequest(); err != nil {
+		t.Errorf("STUN binding request failed: %v", err)
+	}
+
+	relayed, err := c.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayed.Close()
+	if got := testutil.ToFloat64(s.allocationsGauge); got != 1 {
+		t.Errorf("allocations is %v, want 1", got)
+	}
+
+	peer := newPeer(t)
+	if _, err := relayed.WriteTo([]byte("offer"), peer.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	got, from := read(t, peer)
+	if string(got) != "offer" {
+		t.Fatalf("peer got %q, want %q", got, "offer")
+	}
+	if _, err := peer.WriteTo([]byte("answer"), from); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = read(t, relayed)
+	if string(got) != "answer" {
+		t.Fatalf("client got %q, want %q", got, "answer")
+	}
+
+	for dir, want := range map[string]float64{"to_peer": 5, "from_peer": 6} {
+		if got := testutil.ToFloat64(s.bytesCounter.WithLabelValues(dir)); got != want {
+			t.Errorf("%s bytes is %v, want %v", dir, got, want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	username, _ := Credentials(secret, time.Now().Add(time.Hour))
+	_, wrongPassword := Credentials("other secret", time.Now().Add(time.Hour))
+	expiredUsername, expiredPassword := Credentials(secret, time.Now().Add(-time.Hour))
+	for _, c := range []struct {
+		name, username, password string
+	}{
+		{"wrong password", username, wrongPassword},
+		{"expired", expiredUsername, expiredPassword},
+		{"not ours", "1234", credential(secret, "1234")},
+		{"bad expiry", "soon:wormhole", credential(secret, "soon:wormhole")},
+	} {
+		if _, err := newClient(t, addr, c.username, c.password).Allocate(); err == nil {
+			t.Errorf("%s: allocation succeeded", c.name)
+		}
+	}
+	for reason, want := range map[string]float64{"expired": 1, "badusername": 2} {
+		if got := testutil.ToFloat64(s.authFailedCounter.WithLabelValues(reason)); got != want {
+			t.Errorf("%s auth failures is %v, want %v", reason, got, want)
+		}
+	}
+}
+
+func TestMaxAllocations(t *testing.T) {
+	s, addr := newTestServer(t, &Config{MaxAllocations: 1})
+	username, password := Credentials(secret, time.Now().Add(time.Hour))
+	relayed, err := newClient(t, addr, username, password).Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayed.Close()
+	if _, err := newClient(t, addr, username, password).Allocate(); err == nil {
+		t.Error("allocated more than MaxAllocations")
+	}
+	if got := testutil.ToFloat64(s.refusedCounter.WithLabelValues("allocations")); got != 1 {
+		t.Errorf("refused allocations is %v, want 1", got)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		cfg     Config
+		dropped float64
+		refused float64
+	}{
+		{"bandwidth", Config{Bandwidth: 1}, 1000, 0},
+		{"quota", Config{Quota: 1500}, 0, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s, addr := newTestServer(t, &c.cfg)
+			username, password := Credentials(secret, time.Now().Add(time.Hour))
+			relayed, err := newClient(t, addr, username, password).Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer relayed.Close()
+			peer := newPeer(t)
+
+			msg := bytes.Repeat([]byte{'x'}, 1000)
+			for i := 0; i < 2; i++ {
+				if _, err := relayed.WriteTo(msg, peer.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, _ := read(t, peer); len(got) != len(msg) {
+				t.Fatalf("peer got %d bytes, want %d", len(got), len(msg))
+			}
+			if got, _ := read(t, peer); got != nil {
+				t.Errorf("peer got %d bytes over the quota", len(got))
+			}
+			if got := testutil.ToFloat64(s.droppedCounter); got != c.dropped {
+				t.Errorf("dropped bytes is %v, want %v", got, c.dropped)
+			}
+			if got := testutil.ToFloat64(s.refusedCounter.WithLabelValues("bytes")); got != c.refused {
+				t.Errorf("allocations over their quota is %v, want %v", got, c.refused)
+			}
+		})
+	}
+}
+
+func TestRefusedPeers(t *testing.T) {
+	s, addr := newTestServer(t, nil)
+	s.cfg.allowLoopback = false
+	username, password := Credentials(secret, time.Now().Add(time.Hour))
+	relayed, err := newClient(t, addr, username, password).Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayed.Close()
+
+	peer := newPeer(t)
+	if _, err := relayed.WriteTo([]byte("offer"), peer.LocalAddr()); err == nil {
+		t.Errorf("relayed to %v", peer.LocalAddr())
+	}
+	if got, _ := read(t, peer); got != nil {
+		t.Errorf("peer got %q", got)
+	}
+	if got := testutil.ToFloat64(s.peersCounter); got == 0 {
+		t.Error("no refused peers counted")
+	}
+
+	// Nor are packets for peers that got past the permissions.
+	c := &relayConn{PacketConn: newPeer(t), s: s}
+	if _, err := c.WriteTo([]byte("offer"), peer.LocalAddr()); err == nil {
+		t.Errorf("relayed to %v", peer.LocalAddr())
+	}
+	if got, _ := read(t, peer); got != nil {
+		t.Errorf("peer got %q", got)
+	}
+}
+
+func TestPermit(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	s.cfg.allowLoopback = false
+	s.cfg.RelayIP = net.ParseIP("203.0.113.1")
+	for ip, want := range map[string]bool{
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"fd00::1":         false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"0.0.0.0":         false,
+		"::":              false,
+		"224.0.0.251":     false,
+		"255.255.255.255": false,
+		"203.0.113.1":     false,
+		"203.0.113.2":     true,
+		"2001:db8::1":     true,
+	} {
+		if got := s.permit(net.ParseIP(ip)); got != want {
+			t.Errorf("permit(%v) = %v, want %v", ip, got, want)
+		}
+	}
+	for _, ip := range s.localIPs {
+		if s.permit(ip) {
+			t.Errorf("permitted own address %v", ip)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package signal
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sweepInterval is how often a limiter forgets clients it no longer needs to
+// remember.
+const sweepInterval = time.Minute
+
+// A Limit limits how often clients from the same subnet may do something. The
+// zero Limit doesn't limit anything.
+type Limit struct {
+	// Rate is how many times a second clients may do it on average, and
+	// Burst how many times in a row. Burst must be at least 1 for clients
+	// to be able to do it at all.
+	Rate  float64
+	Burst int
+
+	// Ban is how long clients that go over the limit are turned away for,
+	// from everything the Server limits. If zero, they are only turned away
+	// until they are under the limit again.
+	Ban time.Duration
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate != 0 || l.Burst != 0
+}
+
+// limiter enforces a Server's Limits on the subnets of its clients.
+type limiter struct {
+	book, join     Limit
+	v4bits, v6bits int
+
+	mu        sync.Mutex
+	clients   map[netip.Prefix]*client
+	lastSweep time.Time
+}
+
+// client is what a limiter remembers about a subnet.
+type client struct {
+	book, join *rate.Limiter
+	// bannedUntil is when its ban runs out, if it has been banned.
+	bannedUntil time.Time
+}
+
+func newLimiter(cfg *Config) *limiter {
+	l := &limiter{
+		book:    cfg.BookLimit,
+		join:    cfg.JoinLimit,
+		v4bits:  cfg.IPv4Prefix,
+		v6bits:  cfg.IPv6Prefix,
+		clients: make(map[netip.Prefix]*client),
+	}
+	if l.v4bits == 0 {
+		l.v4bits = 32
+	}
+	if l.v6bits == 0 {
+		l.v6bits = 64
+	}
+	return l
+}
+
+// subnet returns the subnet addr is limited as part of.
+func (l *limiter) subnet(addr netip.Addr) netip.Prefix {
+	addr = addr.Unmap()
+	bits := l.v6bits
+	if addr.Is4() {
+		bits = l.v4bits
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		// Out of range, so limit the address on its own.
+		return netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return p
+}
+
+// allow reports whether a client at addr may book a slot at time now, or
+// join one if joining. If not, it returns why as a kind of protocol error:
+// "throttled" if the client went over a limit just now, or "banned" if it
+// had already been banned for it.
+func (l *limiter) allow(addr netip.Addr, joining bool, now time.Time) (ok bool, kind string) {
+	limit := l.book
+	if joining {
+		limit = l.join
+	}
+	if !limit.enabled() {
+		return true, ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	subnet := l.subnet(addr)
+	c, ok := l.clients[subnet]
+	if !ok {
+		c = &client{}
+		l.clients[subnet] = c
+	}
+	if now.Before(c.bannedUntil) {
+		return false, "banned"
+	}
+	lim := &c.book
+	if joining {
+		lim = &c.join
+	}
+	if *lim == nil {
+		*lim = rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)
+	}
+	if !(*lim).AllowN(now, 1) {
+		if limit.Ban > 0 {
+			c.bannedUntil = now.Add(limit.Ban)
+		}
+		return false, "throttled"
+	}
+	return true, ""
+}
+
+// sweep forgets the clients that are not banned and are back to their full
+// bursts, since they are as good as new. This assumes l.mu is held.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := func(lim *rate.Limiter) bool {
+		return lim == nil || lim.TokensAt(now) >= float64(lim.Burst())
+	}
+	for subnet, c := range l.clients {
+		if !now.Before(c.bannedUntil) && full(c.book) && full(c.join) {
+			delete(l.clients, subnet)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package signal
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLimiterSubnets(t *testing.T) {
+	l := newLimiter(&Config{IPv4Prefix: 24})
+	for _, c := range []struct {
+		a, b string
+		same bool
+	}{
+		{"192.0.2.1", "192.0.2.200", true},
+		{"192.0.2.1", "192.0.3.1", false},
+		{"::ffff:192.0.2.1", "192.0.2.2", true},
+		{"2001:db8::1", "2001:db8::ffff:1", true},
+		{"2001:db8::1", "2001:db8:0:1::1", false},
+	} {
+		a := l.subnet(netip.MustParseAddr(c.a))
+		b := l.subnet(netip.MustParseAddr(c.b))
+		if (a == b) != c.same {
+			t.Errorf("%v and %v are in subnets %v and %v, want same %v", c.a, c.b, a, b, c.same)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(&Config{
+		BookLimit: Limit{Rate: 1, Burst: 2},
+		JoinLimit: Limit{Rate: 1, Burst: 1, Ban: time.Minute},
+	})
+	now := time.Date(2021, 1, 2, 15, 4, 5, 0, time.UTC)
+	addr := netip.MustParseAddr("192.0.2.1")
+	other := netip.MustParseAddr("192.0.2.2")
+	steps := []struct {
+		addr    netip.Addr
+		joining bool
+		after   time.Duration
+		kind    string
+	}{
+		{addr, false, 0, ""},
+		{addr, false, 0, ""},
+		{addr, false, 0, "throttled"},
+		// No ban, so it's enough to slow down.
+		{addr, false, time.Second, ""},
+		{addr, true, 0, ""},
+		{addr, true, 0, "throttled"},
+		{addr, true, time.Second, "banned"},
+		{addr, false, 0, "banned"},
+		{other, true, 0, ""},
+		{addr, true, time.Minute, ""},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		ok, kind := l.allow(s.addr, s.joining, now)
+		if ok != (s.kind == "") || kind != s.kind {
+			t.Errorf("step %d: allow(%v, %v) = %v, %q, want %q", i, s.addr, s.joining, ok, kind, s.kind)
+		}
+	}
+
+	// Once clients are back to normal, they are forgotten.
+	now = now.Add(time.Hour)
+	l.allow(other, true, now)
+	if len(l.clients) != 1 {
+		t.Errorf("remembering %d clients, want 1", len(l.clients))
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	l := newLimiter(&Config{})
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		if ok, kind := l.allow(netip.MustParseAddr("192.0.2.1"), i%2 == 0, now); !ok {
+			t.Fatalf("attempt %d turned away as %q without limits", i, kind)
+		}
+	}
+}
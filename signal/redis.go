@@ -0,0 +1,289 @@
+package signal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrefix is prepended to the keys and channels a RedisStore uses.
+const redisPrefix = "webwormhole:"
+
+// freeScript deletes a slot only if it is still booked for the same link,
+// since it might have expired and been booked again.
+var freeScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// A RedisStore is a SlotStore that keeps slots in Redis, or anything else
+// that speaks its protocol, and relays messages between peers over its
+// publish/subscribe channels. Servers in different processes can share one.
+//
+// Each slot is a key holding a random ID for the pair of peers on it, so
+// that messages for the last peers on a slot can't reach the next ones. The
+// peers get messages on channels named after that ID.
+type RedisStore struct {
+	client redis.UniversalClient
+
+	mu     sync.Mutex
+	rand   *mathrand.Rand
+	booked map[*redisLink]struct{}
+}
+
+// NewRedisStore returns a RedisStore that uses client.
+func NewRedisStore(client redis.UniversalClient) *RedisStore {
+	return &RedisStore{
+		client: client,
+		rand:   mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+		booked: make(map[*redisLink]struct{}),
+	}
+}
+
+func (s *RedisStore) intn(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Intn(n)
+}
+
+func slotKey(slot string) string {
+	return redisPrefix + "slot:" + slot
+}
+
+// Book allocates a free slot. If ctx has a deadline, the slot's key expires
+// then.
+func (s *RedisStore) Book(ctx context.Context) (string, Link, error) {
+	var ttl time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		ttl = time.Until(deadline)
+		if ttl <= 0 {
+			return "", nil, context.DeadlineExceeded
+		}
+	}
+	id, err := newLinkID()
+	if err != nil {
+		return "", nil, err
+	}
+	// Subscribe before booking, so we are there when the peer joins.
+	l, err := s.subscribe(ctx, id, "a")
+	if err != nil {
+		return "", nil, err
+	}
+	slot, err := freeslot(s.intn, func(slot string) (bool, error) {
+		return s.client.SetNX(ctx, slotKey(slot), id, ttl).Result()
+	})
+	if err != nil {
+		l.Close()
+		return "", nil, err
+	}
+	l.slot = slot
+	s.mu.Lock()
+	s.booked[l] = struct{}{}
+	s.mu.Unlock()
+	go l.receive()
+	return slot, l, nil
+}
+
+// Join takes slot and returns a Link to the peer waiting on it.
+func (s *RedisStore) Join(ctx context.Context, slot string) (Link, error) {
+	id, err := s.client.GetDel(ctx, slotKey(slot)).Result()
+	if err == redis.Nil {
+		return nil, ErrNoSuchSlot
+	}
+	if err != nil {
+		return nil, err
+	}
+	l, err := s.subscribe(ctx, id, "b")
+	if err != nil {
+		return nil, err
+	}
+	close(l.joined)
+	n, err := l.publish(ctx, redisMessage{Join: true})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if n == 0 {
+		// The peer went away without freeing the slot.
+		l.Close()
+		return nil, ErrNoSuchSlot
+	}
+	go l.receive()
+	return l, nil
+}
+
+// Busy returns the number of slots booked through this RedisStore that it
+// hasn't seen anyone join yet. Slots booked through other RedisStores
+// sharing the same Redis are not counted.
+func (s *RedisStore) Busy() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.booked)
+}
+
+func (s *RedisStore) untrack(l *redisLink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.booked, l)
+}
+
+// subscribe returns a link for the peer on side of the pair id, subscribed
+// to its channel.
+func (s *RedisStore) subscribe(ctx context.Context, id, side string) (*redisLink, error) {
+	peer := "a"
+	if side == "a" {
+		peer = "b"
+	}
+	l := &redisLink{
+		store:  s,
+		id:     id,
+		own:    redisPrefix + "link:" + id + ":" + side,
+		peer:   redisPrefix + "link:" + id + ":" + peer,
+		joined: make(chan struct{}),
+		msgs:   make(chan Message),
+		done:   make(chan struct{}),
+	}
+	l.pubsub = s.client.Subscribe(ctx, l.own)
+	// Wait for the subscription to be confirmed.
+	if _, err := l.pubsub.Receive(ctx); err != nil {
+		l.pubsub.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// newLinkID returns a random ID for a pair of peers.
+func newLinkID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// redisMessage is what is published on a link's channel.
+type redisMessage struct {
+	// Join is set by the peer joining a slot.
+	Join bool `json:"join,omitempty"`
+	Message
+}
+
+type redisLink struct {
+	store *RedisStore
+	slot  string
+	id    string
+
+	// own is the channel of this end of the link, and peer that of the
+	// other.
+	own, peer string
+	pubsub    *redis.PubSub
+
+	joined   chan struct{}
+	joinOnce sync.Once
+
+	msgs      chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// receive hands the messages published on the link's channel to Recv until
+// the link is closed.
+func (l *redisLink) receive() {
+	ch := l.pubsub.Channel()
+	for {
+		var rm *redis.Message
+		select {
+		case rm = <-ch:
+			if rm == nil {
+				return
+			}
+		case <-l.done:
+			return
+		}
+		var m redisMessage
+		if err := json.Unmarshal([]byte(rm.Payload), &m); err != nil {
+			continue
+		}
+		if m.Join {
+			l.store.untrack(l)
+			l.joinOnce.Do(func() { close(l.joined) })
+			continue
+		}
+		select {
+		case l.msgs <- m.Message:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *redisLink) publish(ctx context.Context, m redisMessage) (int64, error) {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	return l.store.client.Publish(ctx, l.peer, buf).Result()
+}
+
+func (l *redisLink) Joined() <-chan struct{} {
+	return l.joined
+}
+
+func (l *redisLink) Free(ctx context.Context) (bool, error) {
+	if l.slot == "" {
+		return false, nil
+	}
+	n, err := freeScript.Run(ctx, l.store.client, []string{slotKey(l.slot)}, l.id).Int()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+	l.store.untrack(l)
+	return true, nil
+}
+
+func (l *redisLink) Send(ctx context.Context, m Message) error {
+	select {
+	case <-l.joined:
+	default:
+		return errNotJoined
+	}
+	select {
+	case <-l.done:
+		return errLinkClosed
+	default:
+	}
+	_, err := l.publish(ctx, redisMessage{Message: m})
+	return err
+}
+
+func (l *redisLink) Recv(ctx context.Context) (Message, error) {
+	select {
+	case m := <-l.msgs:
+		return m, nil
+	case <-l.done:
+		return Message{}, errLinkClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (l *redisLink) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.store.untrack(l)
+		err = l.pubsub.Close()
+	})
+	return err
+}
@@ -0,0 +1,552 @@
+// Package signal implements the signalling server. It pairs up peers wishing
+// to connect on slots, and relays the messages of their handshake between
+// them. See package wormhole for the clients.
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"nhooyr.io/websocket"
+	"webwormhole.io/relay"
+	"webwormhole.io/wormhole"
+)
+
+// DefaultSlotTimeout is the maximum amount of time a client is allowed to hold
+// a slot, used when a Server's Config does not set one.
+const DefaultSlotTimeout = 12 * time.Hour
+
+// pingInterval is how often to ping clients waiting on a slot.
+const pingInterval = 30 * time.Second
+
+// closePeerTimeout is how long to try telling a peer to hang up for.
+const closePeerTimeout = 5 * time.Second
+
+// shutdownPollInterval is how often Shutdown checks whether all clients are
+// done.
+const shutdownPollInterval = 500 * time.Millisecond
+
+// A Config configures a Server. A nil *Config is valid and uses the defaults
+// for everything.
+type Config struct {
+	// ICEServers are sent to clients as soon as they connect, for them to
+	// use, usually STUN servers.
+	ICEServers []webrtc.ICEServer
+
+	// TURNServer, if not empty, is the address of a TURN server sent to
+	// clients along with ICEServers. Each client gets ephemeral credentials
+	// for it, made with TURNSecret as described in
+	// https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
+	TURNServer string
+	TURNSecret string
+
+	// SlotTimeout is the maximum amount of time a client is allowed to
+	// hold a slot. If zero, DefaultSlotTimeout is used.
+	SlotTimeout time.Duration
+
+	// Logger, if not nil, receives logs of failed connections. If nil,
+	// they go to the standard logger.
+	Logger *log.Logger
+
+	// Store, if not nil, keeps the Server's slots. Servers sharing a
+	// Store share their slots. If nil, the Server keeps them in a
+	// MemoryStore of its own.
+	Store SlotStore
+
+	// BookLimit limits how often clients may book a new slot, and
+	// JoinLimit how often they may try to join one. Clients are told
+	// apart by the subnets of their addresses, IPv4Prefix and IPv6Prefix
+	// bits long. If zero, those are 32 and 64: each IPv4 address, and each
+	// IPv6 /64, which is what an ISP usually gives a customer. The address
+	// is that of the request, or for requests from TrustedProxies, the
+	// one they forwarded it for.
+	BookLimit, JoinLimit   Limit
+	IPv4Prefix, IPv6Prefix int
+
+	// TrustedProxies are the proxies, like load balancers, clients reach
+	// the Server through. Requests from them are taken to be from the
+	// last address in their X-Forwarded-For headers that is not another
+	// of them. Without them, every client behind a proxy shares its
+	// limits.
+	TrustedProxies []netip.Prefix
+}
+
+// A Server is a signalling server. It serves WebSocket connections from
+// clients at the path of the slot they want to join, or at the root to get a
+// new slot. Mount it under a prefix with http.StripPrefix.
+//
+// Each Server has its own metrics, in a registry of its own, and its own
+// slots unless its Config says otherwise. Several can be used at once.
+type Server struct {
+	cfg     Config
+	store   SlotStore
+	limiter *limiter
+
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+
+	// draining is closed once Shutdown is called.
+	draining     chan struct{}
+	drainingOnce sync.Once
+
+	registry             *prometheus.Registry
+	rendezvousCounter    *prometheus.CounterVec
+	iceCounter           *prometheus.CounterVec
+	protocolErrorCounter *prometheus.CounterVec
+	slotsGauge           prometheus.GaugeFunc
+}
+
+// NewServer returns a Server configured by cfg.
+func NewServer(cfg *Config) (*Server, error) {
+	s := &Server{
+		conns:    make(map[*websocket.Conn]struct{}),
+		draining: make(chan struct{}),
+
+		registry: prometheus.NewRegistry(),
+		rendezvousCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Name:      "rendezvous_attempts",
+				Help:      "Number of attempts to rendezvous using the signalling server.",
+			},
+			[]string{"result"},
+		),
+		iceCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Name:      "webrtc_attempts",
+				Help:      "Number of reported ICE results sliced by ICE method used.",
+			},
+			[]string{"result", "method"},
+		),
+		protocolErrorCounter: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "ww",
+				Name:      "protocol_errors",
+				Help:      "Number of bad requests to the signalling server.",
+			},
+			[]string{"kind"},
+		),
+	}
+	if cfg != nil {
+		s.cfg = *cfg
+	}
+	s.limiter = newLimiter(&s.cfg)
+	s.store = s.cfg.Store
+	if s.store == nil {
+		s.store = NewMemoryStore()
+	}
+	s.slotsGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "ww",
+			Name:      "busy_slots",
+			Help:      "Number of currently busy slots.",
+		},
+		func() float64 { return float64(s.store.Busy()) },
+	)
+	if s.cfg.TURNServer != "" && s.cfg.TURNSecret == "" {
+		return nil, errors.New("cannot use a TURN server without a secret")
+	}
+	s.registry.MustRegister(
+		s.rendezvousCounter,
+		s.iceCounter,
+		s.protocolErrorCounter,
+		s.slotsGauge,
+	)
+	return s, nil
+}
+
+// Registry returns the registry of the Server's metrics. Serve it with
+// promhttp.HandlerFor, or gather it along with others using
+// prometheus.Gatherers.
+func (s *Server) Registry() *prometheus.Registry {
+	return s.registry
+}
+
+// ProtocolError counts a bad request of kind in the Server's metrics. It is
+// for bad requests that whatever the Server is part of handles itself.
+func (s *Server) ProtocolError(kind string) {
+	s.protocolErrorCounter.WithLabelValues(kind).Inc()
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
+func (s *Server) slotTimeout() time.Duration {
+	if s.cfg.SlotTimeout == 0 {
+		return DefaultSlotTimeout
+	}
+	return s.cfg.SlotTimeout
+}
+
+// allow reports whether the client that sent r may book a slot, or join one
+// if joining, and if not, why as a kind of protocol error.
+func (s *Server) allow(r *http.Request, joining bool) (ok bool, kind string) {
+	addr, ok := s.clientAddr(r)
+	if !ok {
+		// Not an IP address, so there's nothing to limit it by.
+		return true, ""
+	}
+	return s.limiter.allow(addr, joining, time.Now())
+}
+
+// clientAddr returns the address of the client that sent r, past any of
+// TrustedProxies it came through.
+func (s *Server) clientAddr(r *http.Request) (netip.Addr, bool) {
+	addrport, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := addrport.Addr().Unmap()
+	if !s.trusted(addr) {
+		return addr, true
+	}
+	// Each proxy adds the address it got the request from to the end, so
+	// the client's is the last one a trusted proxy did not add. Anything
+	// before it could have been made up by the client.
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		a, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = a.Unmap()
+		if !s.trusted(addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+// trusted reports whether addr is one of TrustedProxies.
+func (s *Server) trusted(addr netip.Addr) bool {
+	for _, p := range s.cfg.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// track adds conn to the connections Shutdown waits for, unless the Server is
+// shutting down.
+func (s *Server) track(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.draining:
+		return false
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// Shutdown gracefully shuts down the Server. It stops allocating slots, and
+// closes the connections of clients waiting on one, or asking for one, with
+// wormhole.CloseServerDraining. Then it waits for clients that have already
+// met their peers to finish signalling. If ctx is done first, it closes their
+// connections and returns ctx.Err().
+//
+// Shutdown does not close any listeners. Call http.Server's Shutdown once it
+// returns.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainingOnce.Do(func() {
+		s.mu.Lock()
+		close(s.draining)
+		s.mu.Unlock()
+	})
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.conns)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			var wg sync.WaitGroup
+			for conn := range s.conns {
+				wg.Add(1)
+				go func(conn *websocket.Conn) {
+					defer wg.Done()
+					conn.Close(websocket.StatusGoingAway, "server shutting down")
+				}(conn)
+			}
+			s.mu.Unlock()
+			wg.Wait()
+			return ctx.Err()
+		}
+	}
+}
+
+// SupportedProtocol returns whether the server can relay signalling protocol
+// version proto.
+func SupportedProtocol(proto string) bool {
+	for _, p := range wormhole.Protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// turnServers return the configured TURN server with HMAC-based ephemeral
+// credentials.
+func (s *Server) turnServers() []webrtc.ICEServer {
+	if s.cfg.TURNServer == "" {
+		return nil
+	}
+	username, credential := relay.Credentials(s.cfg.TURNSecret, time.Now().Add(s.slotTimeout()))
+	return []webrtc.ICEServer{{
+		URLs:       []string{s.cfg.TURNServer},
+		Username:   username,
+		Credential: credential,
+	}}
+}
+
+// ServeHTTP sets up a rendezvous on a slot and relays messages between the two
+// websockets through the Server's SlotStore.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slotkey := strings.TrimPrefix(r.URL.Path, "/")
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		// This sounds nasty but checking origin only matters if requests
+		// change any user state on the server, aka CSRF. We don't have any
+		// user state other than this ephemeral connection. So it's fine.
+		InsecureSkipVerify: true,
+
+		// Safari has broken compression.
+		// https://github.com/nhooyr/websocket/issues/218
+		CompressionMode: websocket.CompressionDisabled,
+
+		// Protocol version negotiation. The server only relays messages, so it
+		// can serve all the versions whose messages have the same shape.
+		Subprotocols: wormhole.Protocols,
+	})
+	if err != nil {
+		s.logf("%v", err)
+		return
+	}
+	if !SupportedProtocol(conn.Subprotocol()) {
+		// Make sure we negotiated the right protocol, since "blank" is also a
+		// default one.
+		s.protocolErrorCounter.WithLabelValues("wrongversion").Inc()
+		conn.Close(wormhole.CloseWrongProto, "wrong protocol, please upgrade client")
+		return
+	}
+	if ok, kind := s.allow(r, slotkey != ""); !ok {
+		s.protocolErrorCounter.WithLabelValues(kind).Inc()
+		conn.Close(wormhole.CloseThrottled, "too many requests, try again later")
+		return
+	}
+	if !s.track(conn) {
+		s.rendezvousCounter.WithLabelValues("draining").Inc()
+		conn.Close(wormhole.CloseServerDraining, "server shutting down")
+		return
+	}
+	defer s.untrack(conn)
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.slotTimeout())
+
+	initmsg := struct {
+		Slot       string             `json:"slot,omitempty"`
+		ICEServers []webrtc.ICEServer `json:"iceServers,omitempty"`
+	}{}
+	initmsg.ICEServers = append(s.turnServers(), s.cfg.ICEServers...)
+
+	// linkc gets the link to the peer once the two have met.
+	linkc := make(chan Link, 1)
+	go func() {
+		var link Link
+		if slotkey == "" {
+			// Book a new slot.
+			newslot, l, err := s.store.Book(ctx)
+			if errors.Is(err, ErrNoMoreSlots) {
+				s.rendezvousCounter.WithLabelValues("nomoreslots").Inc()
+				conn.Close(wormhole.CloseNoMoreSlots, "cannot allocate slots")
+				return
+			}
+			if err != nil {
+				s.logf("%v", err)
+				conn.Close(websocket.StatusInternalError, "cannot allocate slots")
+				return
+			}
+			defer l.Close()
+			slotkey = newslot
+			initmsg.Slot = slotkey
+			buf, err := json.Marshal(initmsg)
+			if err != nil {
+				s.logf("%v", err)
+				l.Free(ctx)
+				return
+			}
+			err = conn.Write(ctx, websocket.MessageText, buf)
+			if err != nil {
+				s.logf("%v", err)
+				l.Free(ctx)
+				return
+			}
+
+			draining := s.draining
+		wait:
+			for {
+				select {
+				case <-draining:
+					freed, err := l.Free(ctx)
+					if err == nil && !freed {
+						// The peer is joining. Let it.
+						draining = nil
+						continue
+					}
+					if err != nil {
+						s.logf("%v", err)
+					}
+					s.rendezvousCounter.WithLabelValues("draining").Inc()
+					conn.Close(wormhole.CloseServerDraining, "server shutting down")
+					return
+				case <-ctx.Done():
+					s.rendezvousCounter.WithLabelValues("timeout").Inc()
+					l.Free(context.Background())
+					conn.Close(wormhole.CloseSlotTimedOut, "timed out")
+					return
+				case <-time.After(pingInterval):
+					conn.Ping(ctx)
+				case <-l.Joined():
+					break wait
+				}
+			}
+			link = l
+		} else {
+			// Join an existing slot.
+			l, err := s.store.Join(ctx, slotkey)
+			if errors.Is(err, ErrNoSuchSlot) {
+				s.rendezvousCounter.WithLabelValues("nosuchslot").Inc()
+				conn.Close(wormhole.CloseNoSuchSlot, "no such slot")
+				return
+			}
+			if err != nil {
+				s.logf("%v", err)
+				conn.Close(websocket.StatusInternalError, "cannot join slot")
+				return
+			}
+			defer l.Close()
+			initmsg.Slot = slotkey
+			buf, err := json.Marshal(initmsg)
+			if err != nil {
+				s.logf("%v", err)
+				closePeer(l, wormhole.ClosePeerHungUp, "peer hung up")
+				return
+			}
+			err = conn.Write(ctx, websocket.MessageText, buf)
+			if err != nil {
+				s.logf("%v", err)
+				closePeer(l, wormhole.ClosePeerHungUp, "peer hung up")
+				return
+			}
+			link = l
+		}
+		s.rendezvousCounter.WithLabelValues("success").Inc()
+
+		// Relay the peer's messages until either side is done.
+		linkc <- link
+		for {
+			m, err := link.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if m.Close != 0 {
+				conn.Close(m.Close, m.Reason)
+				return
+			}
+			err = conn.Write(ctx, m.Type, m.Data)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	defer cancel()
+	var link Link
+	for {
+		msgType, p, err := conn.Read(ctx)
+		if link == nil {
+			select {
+			case link = <-linkc:
+			default:
+			}
+		}
+		switch websocket.CloseStatus(err) {
+		case wormhole.CloseBadKey:
+			s.iceCounter.WithLabelValues("fail", "badkey").Inc()
+			if link != nil {
+				closePeer(link, wormhole.CloseBadKey, "bad key")
+			}
+			return
+		case wormhole.CloseWebRTCFailed:
+			s.iceCounter.WithLabelValues("fail", "unknown").Inc()
+			return
+		case wormhole.CloseWebRTCSuccess:
+			s.iceCounter.WithLabelValues("success", "unknown").Inc()
+			return
+		case wormhole.CloseWebRTCSuccessDirect:
+			s.iceCounter.WithLabelValues("success", "direct").Inc()
+			return
+		case wormhole.CloseWebRTCSuccessRelay:
+			s.iceCounter.WithLabelValues("success", "relay").Inc()
+			return
+		}
+		if err != nil {
+			s.iceCounter.WithLabelValues("unknown", "unknown").Inc()
+			if link != nil {
+				closePeer(link, wormhole.ClosePeerHungUp, "peer hung up")
+			}
+			return
+		}
+		if link == nil {
+			// We could synchronise with the rendezvous goroutine above and wait for
+			// B to connect, but receiving anything at this stage is a protocol violation
+			// so we should just bail out.
+			return
+		}
+		err = link.Send(ctx, Message{Type: msgType, Data: p})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// closePeer tells the peer at the other end of link to close its connection
+// with code. It doesn't wait long, since whoever calls it is hanging up
+// anyway.
+func closePeer(link Link, code websocket.StatusCode, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), closePeerTimeout)
+	defer cancel()
+	link.Send(ctx, Message{Close: code, Reason: reason})
+}
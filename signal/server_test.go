@@ -0,0 +1,322 @@
+package signal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+	"webwormhole.io/wormhole"
+)
+
+type initMsg struct {
+	Slot       string             `json:"slot"`
+	ICEServers []webrtc.ICEServer `json:"iceServers"`
+}
+
+func newTestServer(t *testing.T, cfg *Config) (*Server, string) {
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := httptest.NewServer(s)
+	t.Cleanup(hs.Close)
+	return s, "ws" + strings.TrimPrefix(hs.URL, "http")
+}
+
+// dial connects to the server at url on slot and reads its first message.
+func dial(ctx context.Context, t *testing.T, url, slot string) (*websocket.Conn, initMsg) {
+	t.Helper()
+	conn, _, err := websocket.Dial(ctx, url+"/"+slot, &websocket.DialOptions{
+		Subprotocols: wormhole.Protocols,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+	var msg initMsg
+	_, buf, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("could not read slot: %v", err)
+	}
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return conn, msg
+}
+
+func TestRendezvous(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stun := webrtc.ICEServer{URLs: []string{"stun:stun.example.com"}}
+	s, url := newTestServer(t, &Config{
+		ICEServers: []webrtc.ICEServer{stun},
+		TURNServer: "turn:turn.example.com",
+		TURNSecret: "secret",
+	})
+
+	a, amsg := dial(ctx, t, url, "")
+	if amsg.Slot == "" {
+		t.Fatal("got no slot")
+	}
+	if got := testutil.ToFloat64(s.slotsGauge); got != 1 {
+		t.Errorf("busy slots is %v, want 1", got)
+	}
+	b, bmsg := dial(ctx, t, url, amsg.Slot)
+	if bmsg.Slot != amsg.Slot {
+		t.Errorf("joined slot %q, want %q", bmsg.Slot, amsg.Slot)
+	}
+	if got := testutil.ToFloat64(s.slotsGauge); got != 0 {
+		t.Errorf("busy slots is %v, want 0", got)
+	}
+
+	ice := bmsg.ICEServers
+	if len(ice) != 2 || ice[1].URLs[0] != stun.URLs[0] {
+		t.Fatalf("got ICE servers %+v, want TURN then STUN", ice)
+	}
+	if ice[0].URLs[0] != "turn:turn.example.com" || !strings.HasSuffix(ice[0].Username, ":wormhole") {
+		t.Errorf("got TURN server %+v", ice[0])
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(ice[0].Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); ice[0].Credential != want {
+		t.Errorf("got TURN credential %v, want %v", ice[0].Credential, want)
+	}
+
+	for _, c := range []struct {
+		from, to *websocket.Conn
+		msg      string
+	}{{b, a, "offer"}, {a, b, "answer"}} {
+		if err := c.from.Write(ctx, websocket.MessageText, []byte(c.msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := c.to.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.msg {
+			t.Errorf("relayed %q, want %q", got, c.msg)
+		}
+	}
+	if got := testutil.ToFloat64(s.rendezvousCounter.WithLabelValues("success")); got != 2 {
+		t.Errorf("successful rendezvous count is %v, want 2", got)
+	}
+}
+
+// TestServers checks that servers in the same process don't share slots or
+// metrics.
+func TestServers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s1, url1 := newTestServer(t, nil)
+	s2, url2 := newTestServer(t, nil)
+
+	_, msg := dial(ctx, t, url1, "")
+	conn, _, err := websocket.Dial(ctx, url2+"/"+msg.Slot, &websocket.DialOptions{
+		Subprotocols: wormhole.Protocols,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	_, _, err = conn.Read(ctx)
+	if got := websocket.CloseStatus(err); got != wormhole.CloseNoSuchSlot {
+		t.Errorf("joining another server's slot closed with %v, want %v", got, wormhole.CloseNoSuchSlot)
+	}
+
+	if got := testutil.ToFloat64(s1.slotsGauge); got != 1 {
+		t.Errorf("first server's busy slots is %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(s2.rendezvousCounter.WithLabelValues("nosuchslot")); got != 1 {
+		t.Errorf("second server's nosuchslot count is %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(s1.rendezvousCounter.WithLabelValues("nosuchslot")); got != 0 {
+		t.Errorf("first server's nosuchslot count is %v, want 0", got)
+	}
+}
+
+func TestWrongProtocol(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, url := newTestServer(t, nil)
+
+	conn, _, err := websocket.Dial(ctx, url+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	_, _, err = conn.Read(ctx)
+	if got := websocket.CloseStatus(err); got != wormhole.CloseWrongProto {
+		t.Errorf("closed with %v, want %v", got, wormhole.CloseWrongProto)
+	}
+	if got := testutil.ToFloat64(s.protocolErrorCounter.WithLabelValues("wrongversion")); got != 1 {
+		t.Errorf("wrongversion count is %v, want 1", got)
+	}
+}
+
+func TestTURNWithoutSecret(t *testing.T) {
+	if _, err := NewServer(&Config{TURNServer: "turn:turn.example.com"}); err == nil {
+		t.Error("NewServer succeeded with a TURN server but no secret")
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, url := newTestServer(t, &Config{
+		JoinLimit: Limit{Rate: 0.001, Burst: 2, Ban: time.Hour},
+		BookLimit: Limit{Rate: 0.001, Burst: 10},
+	})
+
+	for i, want := range []websocket.StatusCode{
+		wormhole.CloseNoSuchSlot,
+		wormhole.CloseNoSuchSlot,
+		wormhole.CloseThrottled,
+	} {
+		conn, _, err := websocket.Dial(ctx, url+"/42", &websocket.DialOptions{
+			Subprotocols: wormhole.Protocols,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		_, _, err = conn.Read(ctx)
+		if got := websocket.CloseStatus(err); got != want {
+			t.Errorf("join %d closed with %v, want %v", i, got, want)
+		}
+	}
+	// Banned from booking slots too.
+	conn, _, err := websocket.Dial(ctx, url+"/", &websocket.DialOptions{
+		Subprotocols: wormhole.Protocols,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	_, _, err = conn.Read(ctx)
+	if got := websocket.CloseStatus(err); got != wormhole.CloseThrottled {
+		t.Errorf("booking while banned closed with %v, want %v", got, wormhole.CloseThrottled)
+	}
+
+	for kind, want := range map[string]float64{"throttled": 1, "banned": 1} {
+		if got := testutil.ToFloat64(s.protocolErrorCounter.WithLabelValues(kind)); got != want {
+			t.Errorf("%s count is %v, want %v", kind, got, want)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	s, err := NewServer(&Config{TrustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		// Only trusted proxies can say who they forward for.
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"[::ffff:10.0.0.1]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"[2001:db8::1]:1234", []string{"2001:db8::2"}, "2001:db8::2"},
+		// What the client added itself is ignored.
+		{"10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1, nonsense"}, "10.0.0.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		for _, h := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		got, ok := s.clientAddr(r)
+		if !ok || got != netip.MustParseAddr(c.want) {
+			t.Errorf("request from %v for %q is from %v, want %v", c.remote, c.forwarded, got, c.want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, url := newTestServer(t, nil)
+
+	waiting, _ := dial(ctx, t, url, "")
+	a, msg := dial(ctx, t, url, "")
+	b, _ := dial(ctx, t, url, msg.Slot)
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(ctx) }()
+
+	_, _, err := waiting.Read(ctx)
+	if got := websocket.CloseStatus(err); got != wormhole.CloseServerDraining {
+		t.Errorf("peer waiting on a slot closed with %v, want %v", got, wormhole.CloseServerDraining)
+	}
+	conn, _, err := websocket.Dial(ctx, url+"/", &websocket.DialOptions{
+		Subprotocols: wormhole.Protocols,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	_, _, err = conn.Read(ctx)
+	if got := websocket.CloseStatus(err); got != wormhole.CloseServerDraining {
+		t.Errorf("peer asking for a slot closed with %v, want %v", got, wormhole.CloseServerDraining)
+	}
+
+	// Peers that have met can still finish.
+	if err := b.Write(ctx, websocket.MessageText, []byte("offer")); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := a.Read(ctx); err != nil || string(got) != "offer" {
+		t.Fatalf("relayed %q, %v while shutting down, want %q", got, err, "offer")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before peers finished", err)
+	default:
+	}
+	a.Close(wormhole.CloseWebRTCSuccessDirect, "")
+	b.Close(wormhole.CloseWebRTCSuccessDirect, "")
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, url := newTestServer(t, nil)
+
+	a, msg := dial(ctx, t, url, "")
+	b, _ := dial(ctx, t, url, msg.Slot)
+
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	done := make(chan error)
+	go func() { done <- s.Shutdown(sctx) }()
+	for _, conn := range []*websocket.Conn{a, b} {
+		_, _, err := conn.Read(ctx)
+		if got := websocket.CloseStatus(err); got != websocket.StatusGoingAway {
+			t.Errorf("peer closed with %v, want %v", got, websocket.StatusGoingAway)
+		}
+	}
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,251 @@
+package signal
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+	"webwormhole.io/wordlist"
+)
+
+var (
+	// ErrNoMoreSlots is returned by a SlotStore's Book when it cannot find a
+	// free slot.
+	ErrNoMoreSlots = errors.New("cannot allocate slots")
+
+	// ErrNoSuchSlot is returned by a SlotStore's Join when nobody is waiting
+	// on the slot.
+	ErrNoSuchSlot = errors.New("no such slot")
+
+	// errLinkClosed is returned by a Link's methods once it is closed.
+	errLinkClosed = errors.New("link closed")
+
+	// errNotJoined is returned by a Link's Send before the other peer has
+	// joined.
+	errNotJoined = errors.New("nobody has joined the slot")
+)
+
+// A SlotStore allocates slots, and pairs up the peers on them. Servers that
+// share a SlotStore share their slots, so a peer can join a slot booked
+// through another Server.
+type SlotStore interface {
+	// Book allocates a free slot, and returns it with the Link of the peer
+	// waiting on it. If ctx has a deadline, the slot is freed by then,
+	// even if the peer goes away without freeing it.
+	Book(ctx context.Context) (slot string, l Link, err error)
+
+	// Join takes slot, so nobody else can join it, and returns a Link to
+	// the peer waiting on it.
+	Join(ctx context.Context, slot string) (Link, error)
+
+	// Busy returns the number of slots booked through the store that
+	// nobody has joined yet.
+	Busy() int
+}
+
+// A Link connects a peer to the other peer on its slot, and relays messages
+// between them.
+type Link interface {
+	// Joined returns a channel that is closed once the other peer joins
+	// the slot. For the peer that joined, it is closed already.
+	Joined() <-chan struct{}
+
+	// Free frees the slot if the other peer hasn't joined it yet, and
+	// reports whether it did.
+	Free(ctx context.Context) (bool, error)
+
+	// Send sends m to the other peer.
+	Send(ctx context.Context, m Message) error
+
+	// Recv waits for a message from the other peer.
+	Recv(ctx context.Context) (Message, error)
+
+	// Close closes the link. It does not free the slot.
+	Close() error
+}
+
+// A Message is relayed from one peer to the other.
+type Message struct {
+	Type websocket.MessageType `json:"type,omitempty"`
+	Data []byte                `json:"data,omitempty"`
+
+	// Close, if not zero, is the status to close the other peer's
+	// connection with, for Reason, instead of sending it Data.
+	Close  websocket.StatusCode `json:"close,omitempty"`
+	Reason string               `json:"reason,omitempty"`
+}
+
+// freeslot tries to find an available numeric slot, favouring smaller numbers.
+// It picks numbers with intn, and books the first one for which book returns
+// true.
+func freeslot(intn func(n int) int, book func(slot string) (bool, error)) (string, error) {
+	try := func(n int) (bool, error) {
+		// Slots reserved for the local network are never allocated.
+		if wordlist.IsLocal(n) {
+			return false, nil
+		}
+		return book(strconv.Itoa(n))
+	}
+	for _, r := range []struct{ tries, bits int }{
+		// Assuming varint encoding, we first try for one byte. That's 7 bits in varint.
+		{64, 7},
+		// Then try for two bytes. 11 bits.
+		{1024, 11},
+		// Then try for three bytes. 16 bits.
+		{2048, 16},
+		// Then try for four bytes. 21 bits.
+		{2048, 21},
+	} {
+		for i := 0; i < r.tries; i++ {
+			n := intn(1 << r.bits)
+			ok, err := try(n)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return strconv.Itoa(n), nil
+			}
+		}
+	}
+	// Give up.
+	return "", ErrNoMoreSlots
+}
+
+// memoryLinkBuffer is how many messages a memoryLink holds for its peer to
+// receive before Send blocks.
+const memoryLinkBuffer = 16
+
+// A MemoryStore is a SlotStore that keeps slots in memory. Only Servers in
+// the same process can share one.
+type MemoryStore struct {
+	mu    sync.Mutex
+	slots map[string]*memoryLink
+	rand  *rand.Rand
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		slots: make(map[string]*memoryLink),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Book allocates a free slot. The slot does not expire on its own, so the
+// waiting peer has to free it.
+func (s *MemoryStore) Book(ctx context.Context) (string, Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := newMemoryLink(s)
+	slot, err := freeslot(s.rand.Intn, func(slot string) (bool, error) {
+		if _, busy := s.slots[slot]; busy {
+			return false, nil
+		}
+		s.slots[slot] = l
+		return true, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	l.slot = slot
+	return slot, l, nil
+}
+
+// Join takes slot and returns a Link to the peer waiting on it.
+func (s *MemoryStore) Join(ctx context.Context, slot string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	waiting, ok := s.slots[slot]
+	if !ok {
+		return nil, ErrNoSuchSlot
+	}
+	delete(s.slots, slot)
+	l := newMemoryLink(s)
+	l.peer, waiting.peer = waiting, l
+	close(l.joined)
+	close(waiting.joined)
+	return l, nil
+}
+
+// Busy returns the number of slots nobody has joined yet.
+func (s *MemoryStore) Busy() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.slots)
+}
+
+// memoryLink is one end of a pair of Links in a MemoryStore. Messages are
+// queued for the other end to receive.
+type memoryLink struct {
+	store *MemoryStore
+	slot  string
+
+	// peer is the other end, set by the store before joined is closed.
+	peer   *memoryLink
+	joined chan struct{}
+
+	msgs      chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMemoryLink(s *MemoryStore) *memoryLink {
+	return &memoryLink{
+		store:  s,
+		joined: make(chan struct{}),
+		msgs:   make(chan Message, memoryLinkBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+func (l *memoryLink) Joined() <-chan struct{} {
+	return l.joined
+}
+
+func (l *memoryLink) Free(ctx context.Context) (bool, error) {
+	l.store.mu.Lock()
+	defer l.store.mu.Unlock()
+	if l.slot == "" || l.store.slots[l.slot] != l {
+		return false, nil
+	}
+	delete(l.store.slots, l.slot)
+	return true, nil
+}
+
+func (l *memoryLink) Send(ctx context.Context, m Message) error {
+	select {
+	case <-l.joined:
+	default:
+		return errNotJoined
+	}
+	select {
+	case l.peer.msgs <- m:
+		return nil
+	case <-l.peer.done:
+		return errLinkClosed
+	case <-l.done:
+		return errLinkClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *memoryLink) Recv(ctx context.Context) (Message, error) {
+	select {
+	case m := <-l.msgs:
+		return m, nil
+	case <-l.done:
+		return Message{}, errLinkClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (l *memoryLink) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
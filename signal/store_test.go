@@ -0,0 +1,202 @@
+package signal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"nhooyr.io/websocket"
+	"webwormhole.io/wormhole"
+)
+
+// newRedisStores returns n RedisStores sharing one miniredis, as if they were
+// in different processes.
+func newRedisStores(t *testing.T, n int) (*miniredis.Miniredis, []*RedisStore) {
+	mr := miniredis.RunT(t)
+	var stores []*RedisStore
+	for i := 0; i < n; i++ {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		stores = append(stores, NewRedisStore(client))
+	}
+	return mr, stores
+}
+
+func TestStores(t *testing.T) {
+	_, rs := newRedisStores(t, 2)
+	mem := NewMemoryStore()
+	for _, c := range []struct {
+		name         string
+		booker, join SlotStore
+	}{
+		{"memory", mem, mem},
+		{"redis", rs[0], rs[1]},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testStore(t, c.booker, c.join)
+		})
+	}
+}
+
+// testStore books slots through booker and joins them through join.
+func testStore(t *testing.T, booker, join SlotStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	slot, a, err := booker.Book(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if got := booker.Busy(); got != 1 {
+		t.Errorf("busy slots is %v, want 1", got)
+	}
+	select {
+	case <-a.Joined():
+		t.Fatal("joined before anyone joined")
+	default:
+	}
+	b, err := join.Join(ctx, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	select {
+	case <-a.Joined():
+	case <-ctx.Done():
+		t.Fatal("never heard the peer join")
+	}
+	if got := booker.Busy(); got != 0 {
+		t.Errorf("busy slots after joining is %v, want 0", got)
+	}
+	if _, err := join.Join(ctx, slot); err != ErrNoSuchSlot {
+		t.Errorf("joining a taken slot returned %v, want %v", err, ErrNoSuchSlot)
+	}
+	if freed, err := a.Free(ctx); freed || err != nil {
+		t.Errorf("freeing a taken slot returned %v, %v, want false", freed, err)
+	}
+
+	for _, c := range []struct {
+		from, to Link
+		msg      Message
+	}{
+		{b, a, Message{Type: websocket.MessageText, Data: []byte("offer")}},
+		{a, b, Message{Type: websocket.MessageBinary, Data: []byte("answer")}},
+		{a, b, Message{Close: wormhole.CloseBadKey, Reason: "bad key"}},
+	} {
+		if err := c.from.Send(ctx, c.msg); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.to.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != c.msg.Type || string(got.Data) != string(c.msg.Data) ||
+			got.Close != c.msg.Close || got.Reason != c.msg.Reason {
+			t.Errorf("relayed %+v, want %+v", got, c.msg)
+		}
+	}
+
+	slot, a, err = booker.Book(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if freed, err := a.Free(ctx); !freed || err != nil {
+		t.Errorf("freeing a booked slot returned %v, %v, want true", freed, err)
+	}
+	if _, err := join.Join(ctx, slot); err != ErrNoSuchSlot {
+		t.Errorf("joining a freed slot returned %v, want %v", err, ErrNoSuchSlot)
+	}
+	if got := booker.Busy(); got != 0 {
+		t.Errorf("busy slots after freeing is %v, want 0", got)
+	}
+}
+
+func TestRedisExpiry(t *testing.T) {
+	mr, rs := newRedisStores(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Slots expire when the context they were booked with does.
+	bctx, bcancel := context.WithTimeout(context.Background(), time.Hour)
+	defer bcancel()
+
+	slot, a, err := rs[0].Book(bctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	mr.FastForward(time.Minute)
+	if _, err := rs[0].Join(ctx, slot); err != nil {
+		t.Fatalf("joining before the slot expired returned %v", err)
+	}
+
+	slot, a, err = rs[0].Book(bctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	mr.FastForward(2 * time.Hour)
+	if _, err := rs[0].Join(ctx, slot); err != ErrNoSuchSlot {
+		t.Errorf("joining an expired slot returned %v, want %v", err, ErrNoSuchSlot)
+	}
+}
+
+// TestRedisPeerGone checks that a slot booked by a peer that went away
+// without freeing it, say because its server crashed, can't be joined.
+func TestRedisPeerGone(t *testing.T) {
+	_, rs := newRedisStores(t, 2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	slot, a, err := rs[0].Book(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, err := rs[1].Join(ctx, slot); err != ErrNoSuchSlot {
+		t.Errorf("joining an abandoned slot returned %v, want %v", err, ErrNoSuchSlot)
+	}
+}
+
+// TestRedisServers checks that peers on different Servers sharing a Redis can
+// meet.
+func TestRedisServers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, rs := newRedisStores(t, 2)
+	s1, url1 := newTestServer(t, &Config{Store: rs[0]})
+	s2, url2 := newTestServer(t, &Config{Store: rs[1]})
+
+	a, msg := dial(ctx, t, url1, "")
+	b, _ := dial(ctx, t, url2, msg.Slot)
+	for _, c := range []struct {
+		from, to *websocket.Conn
+		msg      string
+	}{{b, a, "offer"}, {a, b, "answer"}} {
+		if err := c.from.Write(ctx, websocket.MessageText, []byte(c.msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := c.to.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.msg {
+			t.Errorf("relayed %q, want %q", got, c.msg)
+		}
+	}
+
+	a.Close(wormhole.CloseBadKey, "bad key")
+	_, _, err := b.Read(ctx)
+	if got := websocket.CloseStatus(err); got != wormhole.CloseBadKey {
+		t.Errorf("peer closed with %v, want %v", got, wormhole.CloseBadKey)
+	}
+	for _, s := range []*Server{s1, s2} {
+		if got := testutil.ToFloat64(s.rendezvousCounter.WithLabelValues("success")); got != 1 {
+			t.Errorf("successful rendezvous count is %v, want 1", got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package transfer describes the headers of the files sent over a wormhole by
+// ww and the web client.
+//
+// Each file starts with a JSON header, followed by its data. The header
+// carries the file's name and size, its MIME type, and, if the sender knows
+// them, its Unix permission bits and modification time. The web client
+// declares the same header as FileHeader in web/main.ts.
+package transfer
+
+import (
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Version is the version of the header schema Header describes. It goes up
+// when fields are added. Peers ignore fields they don't know, so a header
+// from a newer peer can still be read, and fields missing from an older
+// peer's header are zero. Headers without a version are from peers that
+// predate it, which send only the name, type and size.
+const Version = 1
+
+// Header is the header of a file.
+type Header struct {
+	Version int    `json:"version,omitempty"`
+	Name    string `json:"name"`
+	Size    int    `json:"size"`
+
+	// Type is the file's MIME type. See DetectType.
+	Type string `json:"type"`
+
+	// Resume is set if the sender waits for the receiver to say how much
+	// of the file it already has before sending it.
+	Resume bool `json:"resume,omitempty"`
+
+	// SHA256 is set if the file's data is followed by a trailer with its
+	// SHA-256 hash.
+	SHA256 bool `json:"sha256,omitempty"`
+
+	// Mode holds the file's permission bits.
+	Mode uint32 `json:"mode,omitempty"`
+	// MTime is the file's modification time in milliseconds since the
+	// Unix epoch.
+	MTime int64 `json:"mtime,omitempty"`
+
+	// Compression is the scheme the file's data is compressed with, if it
+	// is. See package webwormhole.io/compress.
+	Compression string `json:"compression,omitempty"`
+
+	// Stream is set if the file's size isn't known upfront, and its data
+	// is sent as a stream instead.
+	Stream bool `json:"stream,omitempty"`
+}
+
+// FileMode returns the file's permission bits, or 0 if the sender didn't
+// send them.
+func (h Header) FileMode() fs.FileMode {
+	return fs.FileMode(h.Mode).Perm()
+}
+
+// ModTime returns the file's modification time, or the zero time if the
+// sender didn't send it.
+func (h Header) ModTime() time.Time {
+	if h.MTime == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(h.MTime)
+}
+
+// SetModTime sets the file's modification time.
+func (h *Header) SetModTime(t time.Time) {
+	h.MTime = t.UnixMilli()
+}
+
+// SniffLen is how much of the start of a file DetectType looks at.
+const SniffLen = 512
+
+// DetectType returns the MIME type of a file called name that starts with
+// head. It sniffs head for the type, but goes by the extension of name
+// instead when sniffing only tells text from binary. head may be empty if
+// the data isn't known yet, and then only the extension counts.
+func DetectType(name string, head []byte) string {
+	ext := mime.TypeByExtension(path.Ext(name))
+	if len(head) == 0 {
+		return ext
+	}
+	if len(head) > SniffLen {
+		head = head[:SniffLen]
+	}
+	typ := http.DetectContentType(head)
+	if ext != "" && generic(typ) {
+		return ext
+	}
+	return typ
+}
+
+// generic reports whether typ, as returned by http.DetectContentType, is
+// less specific than a type known for an extension is likely to be. It can
+// only tell most kinds of text apart from each other by their extensions.
+func generic(typ string) bool {
+	return typ == "application/octet-stream" || strings.HasPrefix(typ, "text/")
+}
@@ -0,0 +1,206 @@
+package transfer
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mtime = time.Date(2021, 1, 2, 15, 4, 5, 678e6, time.UTC)
+
+// senders are the headers each kind of peer sends for the same file, and
+// what ww should make of them.
+var senders = []struct {
+	name string
+	msg  func(t *testing.T) []byte
+	want Header
+}{
+	{
+		name: "ww",
+		msg: func(t *testing.T) []byte {
+			h := Header{
+				Version: Version,
+				Name:    "notes.txt",
+				Size:    5,
+				Type:    "text/plain; charset=utf-8",
+				SHA256:  true,
+				Mode:    0640,
+			}
+			h.SetModTime(mtime)
+			buf, err := json.Marshal(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf
+		},
+		want: Header{
+			Version: Version,
+			Name:    "notes.txt",
+			Size:    5,
+			Type:    "text/plain; charset=utf-8",
+			SHA256:  true,
+			Mode:    0640,
+			MTime:   mtime.UnixMilli(),
+		},
+	},
+	{
+		// As built by sendfile and Upload.send in web/main.ts.
+		name: "web",
+		msg: func(*testing.T) []byte {
+			return []byte(`{"name":"notes.txt","type":"text/plain","size":5,"mtime":1609599845678,"version":1,"sha256":true}`)
+		},
+		want: Header{
+			Version: Version,
+			Name:    "notes.txt",
+			Size:    5,
+			Type:    "text/plain",
+			SHA256:  true,
+			MTime:   mtime.UnixMilli(),
+		},
+	},
+	{
+		name: "old ww",
+		msg: func(*testing.T) []byte {
+			return []byte(`{"name":"notes.txt","size":5,"type":""}`)
+		},
+		want: Header{Name: "notes.txt", Size: 5},
+	},
+	{
+		name: "old web",
+		msg: func(*testing.T) []byte {
+			return []byte(`{"name":"notes.txt","type":"text/plain","size":5}`)
+		},
+		want: Header{Name: "notes.txt", Size: 5, Type: "text/plain"},
+	},
+}
+
+func TestHeaderToWW(t *testing.T) {
+	for _, s := range senders {
+		var h Header
+		if err := json.Unmarshal(s.msg(t), &h); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if h != s.want {
+			t.Errorf("%s: got %+v, want %+v", s.name, h, s.want)
+		}
+		wantMode := fs.FileMode(s.want.Mode)
+		if got := h.FileMode(); got != wantMode {
+			t.Errorf("%s: got mode %v, want %v", s.name, got, wantMode)
+		}
+		if s.want.MTime == 0 {
+			if !h.ModTime().IsZero() {
+				t.Errorf("%s: got modification time %v, want none", s.name, h.ModTime())
+			}
+		} else if !h.ModTime().Equal(mtime) {
+			t.Errorf("%s: got modification time %v, want %v", s.name, h.ModTime(), mtime)
+		}
+	}
+}
+
+func TestHeaderToWeb(t *testing.T) {
+	for _, s := range senders {
+		var h map[string]interface{}
+		if err := json.Unmarshal(s.msg(t), &h); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		// The web client reads these without checking they are there.
+		if _, ok := h["name"].(string); !ok {
+			t.Errorf("%s: name is %#v, want a string", s.name, h["name"])
+		}
+		if _, ok := h["type"].(string); !ok {
+			t.Errorf("%s: type is %#v, want a string", s.name, h["type"])
+		}
+		if _, ok := h["size"].(float64); !ok {
+			t.Errorf("%s: size is %#v, want a number", s.name, h["size"])
+		}
+		if s.want.MTime != 0 && h["mtime"] != float64(mtime.UnixMilli()) {
+			t.Errorf("%s: mtime is %#v, want %d", s.name, h["mtime"], mtime.UnixMilli())
+		}
+	}
+}
+
+// TestWebFields checks that ww knows every field the web client might send.
+func TestWebFields(t *testing.T) {
+	known := make(map[string]bool)
+	typ := reflect.TypeOf(Header{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		known[name] = true
+	}
+	for _, f := range webFields(t) {
+		if !known[f] {
+			t.Errorf("FileHeader in web/main.ts has field %q, which Header doesn't", f)
+		}
+	}
+}
+
+// webFields returns the names of the fields of FileHeader in web/main.ts.
+func webFields(t *testing.T) []string {
+	src, err := os.ReadFile("../web/main.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decl := regexp.MustCompile(`(?s)\ninterface FileHeader \{\n(.*?)\n\}`).FindSubmatch(src)
+	if decl == nil {
+		t.Fatal("no FileHeader in web/main.ts")
+	}
+	var fields []string
+	for _, m := range regexp.MustCompile(`(?m)^\t(\w+)\??:`).FindAllSubmatch(decl[1], -1) {
+		fields = append(fields, string(m[1]))
+	}
+	if len(fields) == 0 {
+		t.Fatal("FileHeader in web/main.ts has no fields")
+	}
+	return fields
+}
+
+func TestRoundTrip(t *testing.T) {
+	headers := []Header{
+		{},
+		{Version: Version, Name: "dir", Type: "inode/directory", Mode: 0755, MTime: mtime.UnixMilli()},
+		{Version: Version, Name: "see you at 6", Type: "application/webwormhole-text"},
+		{Version: Version, Name: "stdin", Stream: true, Compression: "zstd", SHA256: true},
+		{Version: Version, Name: "a/b/c.bin", Size: 1 << 40, Type: "application/octet-stream", Resume: true, Mode: 0600},
+	}
+	for _, h := range headers {
+		buf, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Header
+		if err := json.Unmarshal(buf, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != h {
+			t.Errorf("%s: got %+v back", buf, got)
+		}
+	}
+}
+
+func TestDetectType(t *testing.T) {
+	cases := []struct {
+		name string
+		head string
+		want string
+	}{
+		{"notes", "hello", "text/plain; charset=utf-8"},
+		{"data.json", `{"a": 1}`, "application/json"},
+		{"icon.svg", `<?xml version="1.0"?><svg></svg>`, "image/svg+xml"},
+		// The data wins over a misleading extension.
+		{"photo.png", "\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"photo", "\x89PNG\r\n\x1a\n", "image/png"},
+		{"blob", "\x00\x01\x02", "application/octet-stream"},
+		{"photo.png", "", "image/png"},
+		{"unknown", "", ""},
+	}
+	for _, c := range cases {
+		if got := DetectType(c.name, []byte(c.head)); got != c.want {
+			t.Errorf("DetectType(%q, %q) = %q, want %q", c.name, c.head, got, c.want)
+		}
+	}
+}
@@ -8,6 +8,14 @@ let receiving;
 let sending;
 // sendqueue is the queue of objects waiting to be sent.
 let sendqueue = [];
+// offering is true while waiting for the peer to accept the objects about
+// to be sent.
+let offering = false;
+// manifestreply is called with the peer's answer to the manifest we sent.
+let manifestreply;
+// dclock is held while sending messages that must not be interleaved with
+// others on the data channel, like a file's header, data and trailer.
+let dclock = Promise.resolve();
 // state is the top-level connection state.
 let state = "disconnected";
 // datachannel is the active datachannel, if we're connected.
@@ -18,6 +26,20 @@ let serviceworker;
 let signalserver = new URL(location.href);
 // peerconnection is the active connection's WebRTC object. Global to help debugging.
 let peerconnection;
+// features are the extensions to the file transfer protocol we support.
+// See cmd/ww/hello.go.
+const features = ["sha256", "manifest", "stream", "text", "zstd", "deflate"];
+// compressionschemes are the compression schemes we support, most preferred
+// first. See package compress.
+const compressionschemes = ["zstd", "deflate"];
+// headerversion is the version of FileHeader we send. See package transfer.
+const headerversion = 1;
+// hellotimeout is how long to wait for the peer to say which extensions it
+// supports, in milliseconds.
+const hellotimeout = 3000;
+// peerfeatures resolves to the extensions the peer supports once it says,
+// or to none if it doesn't say in time.
+let peerfeatures = Promise.resolve(new Set());
 // UI elements.
 let filepicker;
 let dialButton;
@@ -50,8 +72,15 @@ class DataChannelWriter {
             if (end > buf.length) {
                 end = buf.length;
             }
+            let chunk = buf.subarray(offset, end);
+            if (this.scheme) {
+                chunk = webwormhole.compress(this.scheme, chunk);
+                if (!chunk) {
+                    throw "could not compress data";
+                }
+            }
             await this.ready;
-            this.dc.send(buf.subarray(offset, end));
+            this.dc.send(chunk);
         }
         if (this.dc.bufferedAmount >= this.bufferedAmountHighThreshold) {
             this.ready = new Promise((resolve) => {
@@ -76,14 +105,29 @@ class Upload {
             }
         }
     }
-    async send(dc) {
+    async send(dc, supported) {
         console.log("sending", this.header.name, this.header.type);
+        this.header.version = headerversion;
         this.li.classList.remove("pending");
         this.li.classList.add("upload");
         this.li.appendChild(document.createElement("progress"));
         this.progress = this.li.getElementsByTagName("progress")[0];
+        // Text has no data to hash.
+        if (supported.has("sha256") &&
+            this.header.type !== "application/webwormhole-text") {
+            this.header.sha256 = true;
+            this.hash = webwormhole.sha256new();
+        }
+        // Don't bother compressing what's compressed already.
+        const scheme = compressionschemes.find((s) => supported.has(s));
+        if (scheme &&
+            this.header.type !== "application/webwormhole-text" &&
+            webwormhole.compressible(this.header.type)) {
+            this.header.compression = scheme;
+        }
         dc.send(new TextEncoder().encode(JSON.stringify(this.header)));
         const writer = new DataChannelWriter(dc);
+        writer.scheme = this.header.compression;
         if (this.stream) {
             const reader = this.stream.getReader();
             while (true) {
@@ -92,9 +136,13 @@ class Upload {
                     break;
                 }
                 await writer.write(value);
+                if (this.hash !== undefined) {
+                    webwormhole.sha256write(this.hash, value);
+                }
                 this.offset += value.length;
                 this.progress.value = this.offset / this.header.size;
             }
+            await this.trailer(writer);
             this.li.removeChild(this.progress);
             return;
         }
@@ -115,18 +163,72 @@ class Upload {
                 if (end > this.blob.size) {
                     end = this.blob.size;
                 }
-                await writer.write(await read(this.blob.slice(this.offset, end)));
+                const chunk = await read(this.blob.slice(this.offset, end));
+                await writer.write(chunk);
+                if (this.hash !== undefined) {
+                    webwormhole.sha256write(this.hash, chunk);
+                }
                 this.offset = end;
                 this.progress.value = this.offset / this.blob.size;
             }
+            await this.trailer(writer);
             this.li.removeChild(this.progress);
             return;
         }
     }
+    // trailer sends the hash of the data, if the header says it will.
+    async trailer(writer) {
+        if (this.hash === undefined) {
+            return;
+        }
+        const trailer = {
+            type: "application/webwormhole-trailer",
+            sha256: base64(webwormhole.sha256sum(this.hash)),
+        };
+        this.hash = undefined;
+        // The trailer is never compressed.
+        writer.scheme = undefined;
+        await writer.write(new TextEncoder().encode(JSON.stringify(trailer)));
+    }
+}
+function base64(b) {
+    return btoa(String.fromCharCode(...b));
+}
+// checktrailer finishes the hash h of a received file and checks it matches
+// the one in the trailer message e.
+function checktrailer(h, e) {
+    const sum = webwormhole.sha256sum(h);
+    const trailer = JSON.parse(new TextDecoder("utf8").decode(e.data));
+    return (trailer.type === "application/webwormhole-trailer" &&
+        trailer.sha256 === base64(sum));
+}
+// unframe returns the data carried by a message of the file with header h,
+// or undefined if it marks the end of a stream.
+function unframe(h, data) {
+    if (h.stream) {
+        if (new Uint8Array(data)[0] === 0) {
+            return undefined;
+        }
+        data = data.slice(1);
+    }
+    if (h.compression) {
+        data = decompress(h.compression, data);
+    }
+    return data;
+}
+// decompress returns the data carried by a message of a file compressed with
+// scheme.
+function decompress(scheme, data) {
+    const block = webwormhole.decompress(scheme, new Uint8Array(data));
+    if (!block) {
+        throw "could not decompress data";
+    }
+    return block.buffer;
 }
 class ServiceWorkerDownload {
     constructor(sw, header) {
         this.offset = 0;
+        this.ended = false;
         this.li = document.createElement("li");
         this.a = document.createElement("a");
         this.progress = document.createElement("progress");
@@ -138,38 +240,79 @@ class ServiceWorkerDownload {
         this.li.appendChild(this.progress);
         this.li.classList.add("download");
         transfersList.appendChild(this.li);
+        if (header.sha256) {
+            this.hash = webwormhole.sha256new();
+        }
         sw.postMessage({
             id: this.id,
             type: "metadata",
             name: header.name,
-            size: header.size,
-            filetype: header.type,
+            size: header.stream ? undefined : header.size,
+            filetype: header.type || "application/octet-stream",
         });
         this.triggerDownload();
     }
     receive(e) {
-        const chunkSize = e.data.byteLength;
-        if (this.offset + chunkSize > this.header.size) {
+        if (this.hash !== undefined && this.received()) {
+            const ok = checktrailer(this.hash, e);
+            this.hash = undefined;
+            if (!ok) {
+                const error = "integrity check failed";
+                this.sw.postMessage({ id: this.id, type: "error", error });
+                corrupt(this.li, this.progress);
+                return;
+            }
+            this.finish();
+            return;
+        }
+        const data = unframe(this.header, e.data);
+        if (!data) {
+            this.ended = true;
+            if (this.done()) {
+                this.finish();
+            }
+            return;
+        }
+        const chunkSize = data.byteLength;
+        if (!this.header.stream && this.offset + chunkSize > this.header.size) {
             const error = "received more bytes than expected";
             this.sw.postMessage({ id: this.id, type: "error", error });
             throw error;
         }
+        // Hash before the data is transferred to the service worker.
+        if (this.hash !== undefined) {
+            webwormhole.sha256write(this.hash, new Uint8Array(data));
+        }
         this.sw.postMessage({
             id: this.id,
             type: "data",
-            data: e.data,
+            data: data,
             offset: this.offset,
-        }, [e.data]);
+        }, [data]);
         this.offset += chunkSize;
-        this.progress.value = this.offset / this.header.size;
+        if (!this.header.stream) {
+            this.progress.value = this.offset / this.header.size;
+        }
         if (this.done()) {
-            this.sw.postMessage({ id: this.id, type: "end" });
-            this.li.removeChild(this.progress);
+            this.finish();
         }
     }
-    done() {
+    finish() {
+        this.sw.postMessage({ id: this.id, type: "end" });
+        this.li.removeChild(this.progress);
+    }
+    // received is true once all the data has been received.
+    received() {
+        if (this.header.stream) {
+            return this.ended;
+        }
         return this.offset === this.header.size;
     }
+    // done is true once all the data, and the trailer if there is one, has
+    // been received.
+    done() {
+        return this.received() && this.hash === undefined;
+    }
     cancel() {
         this.sw.postMessage({
             id: this.id,
@@ -194,39 +337,89 @@ class ServiceWorkerDownload {
 }
 class ArrayBufferDownload {
     constructor(header) {
+        this.chunks = []; // Of streams, which have no size upfront.
         this.offset = 0;
+        this.ended = false;
         this.li = document.createElement("li");
         this.a = document.createElement("a");
         this.progress = document.createElement("progress");
         this.header = header;
-        this.data = new Uint8Array(header.size);
+        this.data = new Uint8Array(header.stream ? 0 : header.size);
         this.a.appendChild(document.createTextNode(`${header.name}`));
         this.li.appendChild(this.a);
         this.li.appendChild(this.progress);
         this.li.classList.add("download");
         transfersList.appendChild(this.li);
+        if (header.sha256) {
+            this.hash = webwormhole.sha256new();
+        }
     }
     receive(e) {
-        const chunkSize = e.data.byteLength;
-        if (this.offset + chunkSize > this.header.size) {
+        if (this.hash !== undefined && this.received()) {
+            const ok = checktrailer(this.hash, e);
+            this.hash = undefined;
+            if (!ok) {
+                corrupt(this.li, this.progress);
+                return;
+            }
+            this.finish();
+            return;
+        }
+        const data = unframe(this.header, e.data);
+        if (!data) {
+            this.ended = true;
+            if (this.done()) {
+                this.finish();
+            }
+            return;
+        }
+        const chunkSize = data.byteLength;
+        if (!this.header.stream && this.offset + chunkSize > this.header.size) {
             const error = "received more bytes than expected";
             throw error;
         }
-        this.data.set(new Uint8Array(e.data), this.offset);
+        const chunk = new Uint8Array(data);
+        if (this.header.stream) {
+            this.chunks.push(chunk);
+        }
+        else {
+            this.data.set(chunk, this.offset);
+        }
+        if (this.hash !== undefined) {
+            webwormhole.sha256write(this.hash, chunk);
+        }
         this.offset += chunkSize;
-        this.progress.value = this.offset / this.header.size;
+        if (!this.header.stream) {
+            this.progress.value = this.offset / this.header.size;
+        }
         if (this.done()) {
-            this.triggerDownload();
-            this.li.removeChild(this.progress);
+            this.finish();
         }
     }
-    done() {
+    finish() {
+        this.triggerDownload();
+        this.li.removeChild(this.progress);
+    }
+    // received is true once all the data has been received.
+    received() {
+        if (this.header.stream) {
+            return this.ended;
+        }
         return this.offset === this.header.size;
     }
+    // done is true once all the data, and the trailer if there is one, has
+    // been received.
+    done() {
+        return this.received() && this.hash === undefined;
+    }
     cancel() { }
+    blob() {
+        const parts = this.header.stream ? this.chunks : [this.data];
+        return new Blob(parts, { type: this.header.type });
+    }
     triggerDownload() {
         if (hacks.noblob) {
-            const blob = new Blob([this.data], { type: this.header.type });
+            const blob = this.blob();
             const fr = new FileReader();
             fr.onloadend = () => {
                 this.a.href = fr.result;
@@ -235,12 +428,18 @@ class ArrayBufferDownload {
             fr.readAsDataURL(blob);
             return;
         }
-        const blob = new Blob([this.data], { type: this.header.type });
+        const blob = this.blob();
         this.a.href = URL.createObjectURL(blob);
         this.a.download = this.header.name;
         this.a.click();
     }
 }
+// corrupt marks a download as failing its integrity check.
+function corrupt(li, progress) {
+    li.removeChild(progress);
+    li.classList.add("corrupt");
+    li.appendChild(document.createTextNode(" (corrupted, discarded)"));
+}
 function pick() {
     if (!filepicker.files) {
         return;
@@ -319,6 +518,7 @@ async function sendfile(f) {
         name: f.name,
         type: f.type,
         size: f.size,
+        mtime: f.lastModified,
     }, f);
     item.li.classList.add("pending");
     item.li.innerText = `${f.name}`;
@@ -333,14 +533,115 @@ async function send(item) {
         console.log("adding to queue: not connected");
         return;
     }
-    if (sending) {
+    if (sending || offering) {
         console.log("adding to queue: haven't finished sending current file");
         return;
     }
-    while ((sending = sendqueue.shift())) {
-        await sending.send(datachannel);
-        sending = undefined;
+    const dc = datachannel;
+    while (sendqueue.length > 0) {
+        const supported = await peerfeatures;
+        const batch = sendqueue;
+        sendqueue = [];
+        if (supported.has("manifest")) {
+            offering = true;
+            const accept = await offer(dc, batch);
+            offering = false;
+            if (!accept) {
+                for (let i = 0; i < batch.length; i++) {
+                    declined(batch[i]);
+                }
+                continue;
+            }
+        }
+        while ((sending = batch.shift())) {
+            const item = sending;
+            await locked(() => item.send(dc, supported));
+            sending = undefined;
+        }
+    }
+}
+// locked runs f once nothing else holds dclock, and holds it until f is done.
+async function locked(f) {
+    const prev = dclock;
+    let release = () => { };
+    dclock = new Promise((resolve) => {
+        release = resolve;
+    });
+    await prev;
+    try {
+        await f();
+    }
+    finally {
+        release();
+    }
+}
+// offer sends the manifest for batch and returns whether the peer accepted
+// it. See cmd/ww/manifest.go.
+async function offer(dc, batch) {
+    const m = {
+        type: "application/webwormhole-manifest",
+        count: batch.length,
+        size: 0,
+        names: [],
+    };
+    // Keep the manifest within a message.
+    let namessize = 0;
+    for (let i = 0; i < batch.length; i++) {
+        m.size += batch[i].header.size;
+        namessize += batch[i].header.name.length;
+        if (namessize <= 32 << 10) {
+            m.names.push(batch[i].header.name);
+        }
+    }
+    const reply = new Promise((resolve) => {
+        manifestreply = resolve;
+    });
+    await locked(async () => {
+        dc.send(new TextEncoder().encode(JSON.stringify(m)));
+    });
+    const accept = await reply;
+    manifestreply = undefined;
+    return accept;
+}
+// answer asks the user whether to accept the files in the manifest m, and
+// tells the peer.
+function answer(m) {
+    const shown = m.names.slice(0, 10);
+    let total = `${humansize(m.size)} in total`;
+    if (m.streams) {
+        total += `, not counting ${m.streams} of unknown size`;
+    }
+    let question = `Receive ${m.count} files, ${total}?\n\n`;
+    question += shown.join("\n");
+    if (m.count > shown.length) {
+        question += `\n...and ${m.count - shown.length} more`;
+    }
+    const reply = {
+        type: "application/webwormhole-manifest-reply",
+        accept: confirm(question),
+    };
+    locked(async () => {
+        if (datachannel) {
+            datachannel.send(new TextEncoder().encode(JSON.stringify(reply)));
+        }
+    });
+}
+// declined marks an upload as declined by the peer.
+function declined(item) {
+    item.li.classList.remove("pending");
+    item.li.classList.add("declined");
+    item.li.appendChild(document.createTextNode(" (declined)"));
+}
+function humansize(n) {
+    if (n < 1000) {
+        return `${n} B`;
+    }
+    let exp = 0;
+    while (n >= 1000 * 1000 && exp < 5) {
+        n /= 1000;
+        exp++;
     }
+    return `${(n / 1000).toFixed(1)} ${"kMGTPE"[exp]}B`;
 }
 function receive(e) {
     if (receiving) {
@@ -350,7 +651,18 @@ function receive(e) {
         }
         return;
     }
-    const header = JSON.parse(new TextDecoder("utf8").decode(e.data));
+    const msg = JSON.parse(new TextDecoder("utf8").decode(e.data));
+    if (msg.type === "application/webwormhole-manifest") {
+        answer(msg);
+        return;
+    }
+    if (msg.type === "application/webwormhole-manifest-reply") {
+        if (manifestreply) {
+            manifestreply(msg.accept);
+        }
+        return;
+    }
+    const header = msg;
     // Special case raw text that's been received.
     if (header.type === "application/webwormhole-text") {
         const li = document.createElement("li");
@@ -405,10 +717,28 @@ async function connect() {
                     }
                 }
             };
+            let gothello;
+            peerfeatures = new Promise((resolve) => {
+                gothello = resolve;
+            });
+            pc.ondatachannel = (e) => {
+                if (e.channel.label !== "webwormhole-hello") {
+                    return;
+                }
+                e.channel.binaryType = "arraybuffer";
+                e.channel.onmessage = (m) => {
+                    const hello = JSON.parse(typeof m.data === "string"
+                        ? m.data
+                        : new TextDecoder("utf8").decode(m.data));
+                    console.log("peer supports:", hello.features);
+                    gothello(new Set(hello.features));
+                };
+            };
             const dc = pc.createDataChannel("data", { negotiated: true, id: 0 });
             dc.onopen = () => {
                 connected();
                 datachannel = dc;
+                setTimeout(() => gothello(new Set()), hellotimeout);
                 // Send anything we have waiting in the send queue.
                 send();
             };
@@ -420,6 +750,10 @@ async function connect() {
             dc.onerror = (e) => {
                 disconnected(`datachannel error: ${e.error}`);
             };
+            const hellodc = pc.createDataChannel("webwormhole-hello");
+            hellodc.onopen = () => {
+                hellodc.send(JSON.stringify({ features }));
+            };
         };
         const fingerprint = await w.dial();
         // To make it more likely to spot the 1 in 2^16 chance of a successful
@@ -464,6 +798,9 @@ function disconnected(reason) {
     state = "disconnected";
     datachannel = null;
     sendqueue = [];
+    if (manifestreply) {
+        manifestreply(false);
+    }
     document.body.style.backgroundColor = "";
     // TODO better error types or at least hoist the strings to consts.
     if (reason === "bad key") {
@@ -478,6 +815,14 @@ function disconnected(reason) {
     else if (reason === "timed out") {
         infoBox.innerText = "Wormhole expired.";
     }
+    else if (reason === "signalling server shutting down") {
+        infoBox.innerText =
+            "The signalling server is restarting. Try again in a moment.";
+    }
+    else if (reason === "throttled") {
+        infoBox.innerText =
+            "Too many wormholes from your network. Try again in a few minutes.";
+    }
     else if (reason === "could not connect to signalling server") {
         infoBox.innerText =
             "Could not reach the signalling server. Refresh page and try again.";
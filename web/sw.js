@@ -92,13 +92,15 @@ async function streamDownload(id) {
     }
     const { size, name, filetype, stream } = s;
     console.log(`downloading ${name} (${id})`);
-    return new Response(stream, {
-        headers: {
-            "Content-Type": filetype,
-            "Content-Length": size,
-            "Content-Disposition": `attachment; filename*=UTF-8''${encodeFilename(name)}`,
-        },
-    });
+    const headers = {
+        "Content-Type": filetype,
+        "Content-Disposition": `attachment; filename*=UTF-8''${encodeFilename(name)}`,
+    };
+    // Streams have no size upfront.
+    if (size !== undefined) {
+        headers["Content-Length"] = `${size}`;
+    }
+    return new Response(stream, { headers });
 }
 async function streamUpload(e) {
     const contentLength = e.request.headers.get("content-length");
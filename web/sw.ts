@@ -117,15 +117,17 @@ async function streamDownload(id: string) {
 
 	console.log(`downloading ${name} (${id})`);
 
-	return new Response(stream, {
-		headers: {
-			"Content-Type": filetype,
-			"Content-Length": size,
-			"Content-Disposition": `attachment; filename*=UTF-8''${encodeFilename(
-				name
-			)}`,
-		},
-	});
+	const headers: Record<string, string> = {
+		"Content-Type": filetype,
+		"Content-Disposition": `attachment; filename*=UTF-8''${encodeFilename(
+			name
+		)}`,
+	};
+	// Streams have no size upfront.
+	if (size !== undefined) {
+		headers["Content-Length"] = `${size}`;
+	}
+	return new Response(stream, { headers });
 }
 
 async function streamUpload(e: FetchEvent) {
@@ -10,6 +10,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"hash"
 	"io"
 	"strconv"
 	"syscall/js"
@@ -18,6 +19,7 @@ import (
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
 	"rsc.io/qr"
+	"webwormhole.io/compress"
 	"webwormhole.io/wordlist"
 )
 
@@ -182,6 +184,78 @@ func fingerprint(_ js.Value, args []js.Value) interface{} {
 	return dst
 }
 
+// hashes are the SHA-256 hashes in progress, by the handles we give
+// JavaScript instead of pointers.
+var (
+	hashes   = make(map[int]hash.Hash)
+	lasthash int
+)
+
+// sha256new() (h int)
+func sha256new(_ js.Value, _ []js.Value) interface{} {
+	lasthash++
+	hashes[lasthash] = sha256.New()
+	return lasthash
+}
+
+// sha256write(h int, data uint8array)
+func sha256write(_ js.Value, args []js.Value) interface{} {
+	h, ok := hashes[args[0].Int()]
+	if !ok {
+		return nil
+	}
+	data := make([]byte, args[1].Length())
+	js.CopyBytesToGo(data, args[1])
+	h.Write(data)
+	return nil
+}
+
+// sha256sum(h int) (sum uint8array)
+//
+// The handle can't be used after this.
+func sha256sum(_ js.Value, args []js.Value) interface{} {
+	h, ok := hashes[args[0].Int()]
+	if !ok {
+		return nil
+	}
+	delete(hashes, args[0].Int())
+	sum := h.Sum(nil)
+	dst := js.Global().Get("Uint8Array").New(len(sum))
+	js.CopyBytesToJS(dst, sum)
+	return dst
+}
+
+// compressible(type string) bool
+func compressible(_ js.Value, args []js.Value) interface{} {
+	return compress.Compressible(args[0].String())
+}
+
+// compress(scheme string, block uint8array) (msg uint8array)
+func compressblock(_ js.Value, args []js.Value) interface{} {
+	block := make([]byte, args[1].Length())
+	js.CopyBytesToGo(block, args[1])
+	msg, err := compress.Encode(args[0].String(), block)
+	if err != nil {
+		return nil
+	}
+	dst := js.Global().Get("Uint8Array").New(len(msg))
+	js.CopyBytesToJS(dst, msg)
+	return dst
+}
+
+// decompress(scheme string, msg uint8array) (block uint8array)
+func decompressblock(_ js.Value, args []js.Value) interface{} {
+	msg := make([]byte, args[1].Length())
+	js.CopyBytesToGo(msg, args[1])
+	block, err := compress.Decode(args[0].String(), msg)
+	if err != nil {
+		return nil
+	}
+	dst := js.Global().Get("Uint8Array").New(len(block))
+	js.CopyBytesToJS(dst, block)
+	return dst
+}
+
 func main() {
 	js.Global().Set("webwormhole", map[string]interface{}{
 		"start":       js.FuncOf(start),
@@ -194,6 +268,13 @@ func main() {
 		"decode":      js.FuncOf(decode),
 		"match":       js.FuncOf(match),
 		"fingerprint": js.FuncOf(fingerprint),
+		"sha256new":   js.FuncOf(sha256new),
+		"sha256write": js.FuncOf(sha256write),
+		"sha256sum":   js.FuncOf(sha256sum),
+
+		"compressible": js.FuncOf(compressible),
+		"compress":     js.FuncOf(compressblock),
+		"decompress":   js.FuncOf(decompressblock),
 	})
 
 	// Go wasm executables must remain running. Block indefinitely.
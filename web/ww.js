@@ -14,6 +14,8 @@ var WormholeErrorCodes;
     WormholeErrorCodes[WormholeErrorCodes["closeWebRTCSuccessDirect"] = 4007] = "closeWebRTCSuccessDirect";
     WormholeErrorCodes[WormholeErrorCodes["closeWebRTCSuccessRelay"] = 4008] = "closeWebRTCSuccessRelay";
     WormholeErrorCodes[WormholeErrorCodes["closeWebRTCFailed"] = 4009] = "closeWebRTCFailed";
+    WormholeErrorCodes[WormholeErrorCodes["closeServerDraining"] = 4010] = "closeServerDraining";
+    WormholeErrorCodes[WormholeErrorCodes["closeThrottled"] = 4011] = "closeThrottled";
 })(WormholeErrorCodes || (WormholeErrorCodes = {}));
 class Wormhole {
     constructor(signalserver, code) {
@@ -307,6 +309,14 @@ class Wormhole {
                 this.fail("wrong protocol version: must update");
                 return;
             }
+            case WormholeErrorCodes.closeServerDraining: {
+                this.fail("signalling server shutting down");
+                return;
+            }
+            case WormholeErrorCodes.closeThrottled: {
+                this.fail("throttled");
+                return;
+            }
             default: {
                 this.fail(`websocket session closed: ${e.reason} (${e.code})`);
                 return;
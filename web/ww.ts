@@ -14,6 +14,14 @@ declare var webwormhole: {
 
 	match(prefix: string): string;
 	qrencode(url: string): Uint8Array;
+
+	sha256new(): number;
+	sha256write(h: number, data: Uint8Array): void;
+	sha256sum(h: number): Uint8Array;
+
+	compressible(type: string): boolean;
+	compress(scheme: string, block: Uint8Array): Uint8Array | null;
+	decompress(scheme: string, msg: Uint8Array): Uint8Array | null;
 };
 
 // Declare Go WASM loader symbols.
@@ -34,6 +42,8 @@ enum WormholeErrorCodes {
 	closeWebRTCSuccessDirect = 4007,
 	closeWebRTCSuccessRelay = 4008,
 	closeWebRTCFailed = 4009,
+	closeServerDraining = 4010,
+	closeThrottled = 4011,
 }
 
 type State = (msg: string) => Promise<State>;
@@ -394,6 +404,14 @@ class Wormhole {
 				this.fail("wrong protocol version: must update");
 				return;
 			}
+			case WormholeErrorCodes.closeServerDraining: {
+				this.fail("signalling server shutting down");
+				return;
+			}
+			case WormholeErrorCodes.closeThrottled: {
+				this.fail("throttled");
+				return;
+			}
 			default: {
 				this.fail(`websocket session closed: ${e.reason} (${e.code})`);
 				return;
@@ -45,6 +45,20 @@ func Match(prefix string) string {
 	return ""
 }
 
+// Slots from LocalSlotMin to LocalSlotMax are reserved for wormholes on the
+// local network, which peers find using multicast DNS rather than a
+// signalling server. Signalling servers never allocate them. They fit in the
+// shortest codes.
+const (
+	LocalSlotMin = 112
+	LocalSlotMax = 127
+)
+
+// IsLocal returns whether slot is reserved for wormholes on the local network.
+func IsLocal(slot int) bool {
+	return slot >= LocalSlotMin && slot <= LocalSlotMax
+}
+
 // encoding is a string encoding for a vector of bytes.
 type encoding interface {
 	// Encode returns the string encoding of slot and pass.
@@ -56,3 +56,22 @@ func TestMatch(t *testing.T) {
 	}
 
 }
+
+func TestIsLocal(t *testing.T) {
+	cases := []struct {
+		slot  int
+		local bool
+	}{
+		{0, false},
+		{111, false},
+		{112, true},
+		{127, true},
+		{128, false},
+		{112 + 1<<7, false},
+	}
+	for i, c := range cases {
+		if local := IsLocal(c.slot); local != c.local {
+			t.Errorf("testcase %v (%v) got %v want %v", i, c.slot, local, c.local)
+		}
+	}
+}
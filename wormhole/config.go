@@ -0,0 +1,152 @@
+package wormhole
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"golang.org/x/net/proxy"
+)
+
+// A Config configures a wormhole. A nil *Config is valid and uses the
+// defaults for everything.
+type Config struct {
+	// ICEServers are added to the ICE servers suggested by the signalling
+	// server.
+	ICEServers []webrtc.ICEServer
+
+	// OverrideICEServers makes ICEServers replace the ICE servers suggested
+	// by the signalling server instead of adding to them.
+	OverrideICEServers bool
+
+	// SettingEngine, if not nil, is called to adjust the SettingEngine used
+	// to create the PeerConnection. It is called after the defaults are
+	// applied, which detach DataChannels and use the proxy configured in the
+	// environment for ICE.
+	//
+	// DataChannels must remain detached.
+	SettingEngine func(*webrtc.SettingEngine)
+
+	// Logger, if not nil, receives verbose logs of the handshake. If nil,
+	// logs go to the standard logger if Verbose is set.
+	Logger *log.Logger
+
+	// BufferedAmountLowThreshold is the DataChannel's buffered amount low
+	// threshold. Blocked writes are resumed when the buffered amount drops
+	// below it. If zero, 512 KiB is used.
+	BufferedAmountLowThreshold uint64
+
+	// BufferedAmountHighThreshold is the buffered amount above which writes
+	// block. If zero, BufferedAmountLowThreshold is used.
+	BufferedAmountHighThreshold uint64
+
+	// Label is the label of the DataChannel. If empty, "data" is used.
+	Label string
+
+	// ConnectTimeout is the maximum amount of time to wait for the WebRTC
+	// connection to be established once the offer and answer have been
+	// exchanged. If zero, the package's ConnectTimeout is used. If negative,
+	// there is no timeout.
+	ConnectTimeout time.Duration
+
+	// HTTPClient is used to dial the signalling server's WebSocket. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// HTTPHeader holds additional headers for the WebSocket handshake with
+	// the signalling server.
+	HTTPHeader http.Header
+
+	// NoTrickle makes the handshake wait until all local ICE candidates are
+	// gathered and send them in the offer or answer, instead of trickling
+	// them to the remote peer as they are found. It is needed with
+	// Signallers that cannot carry messages after the answer, like ones a
+	// user operates by hand. Both peers should set it.
+	NoTrickle bool
+
+	// RetryDraining makes Accept start over on a new slot if the signalling
+	// server shuts down before the remote peer joins, as RetryDrained does.
+	// New slots are written on slotc without blocking, so callers that want
+	// them should keep reading it, or give it room for them.
+	RetryDraining bool
+
+	// version is the signalling protocol version to speak. If empty,
+	// Protocol is used. Tests set it to emulate older peers.
+	version string
+}
+
+func (cfg *Config) logf(format string, v ...interface{}) {
+	if cfg.Logger != nil {
+		cfg.Logger.Printf(format, v...)
+		return
+	}
+	logf(format, v...)
+}
+
+// iceServers returns the ICE servers to use given the ones suggested by the
+// signalling server.
+func (cfg *Config) iceServers(suggested []webrtc.ICEServer) []webrtc.ICEServer {
+	if cfg.OverrideICEServers {
+		return cfg.ICEServers
+	}
+	return append(suggested, cfg.ICEServers...)
+}
+
+func (cfg *Config) settingEngine() webrtc.SettingEngine {
+	// Accessing pion/webrtc APIs like DataChannel.Detach() requires
+	// that we do this voodoo.
+	s := webrtc.SettingEngine{}
+	s.DetachDataChannels()
+	s.SetICEProxyDialer(proxy.FromEnvironment())
+	if cfg.SettingEngine != nil {
+		cfg.SettingEngine(&s)
+	}
+	return s
+}
+
+func (cfg *Config) lowThreshold() uint64 {
+	if cfg.BufferedAmountLowThreshold == 0 {
+		// Any threshold amount >= 1MiB seems to occasionally lock up pion.
+		// Choose 512 KiB as a safe default.
+		return 512 << 10
+	}
+	return cfg.BufferedAmountLowThreshold
+}
+
+func (cfg *Config) highThreshold() uint64 {
+	if cfg.BufferedAmountHighThreshold == 0 {
+		return cfg.lowThreshold()
+	}
+	return cfg.BufferedAmountHighThreshold
+}
+
+func (cfg *Config) label() string {
+	if cfg.Label == "" {
+		return "data"
+	}
+	return cfg.Label
+}
+
+func (cfg *Config) protocol() string {
+	if cfg.version == "" {
+		return Protocol
+	}
+	return cfg.version
+}
+
+// protocols returns the WebSocket subprotocols to offer the signalling
+// server.
+func (cfg *Config) protocols() []string {
+	if cfg.protocol() == "4" {
+		return []string{"4"}
+	}
+	return Protocols
+}
+
+func (cfg *Config) connectTimeout() time.Duration {
+	if cfg.ConnectTimeout == 0 {
+		return ConnectTimeout
+	}
+	return cfg.ConnectTimeout
+}
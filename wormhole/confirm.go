@@ -0,0 +1,171 @@
+package wormhole
+
+// Version 5 of the signalling protocol adds explicit key confirmation to
+// the handshake. Each peer sends, inside its sealed offer or answer, an HMAC
+// keyed with a key derived from the PAKE secret over:
+//
+//   - the protocol version,
+//   - the slot,
+//   - both PAKE messages,
+//   - and the DTLS certificate fingerprints in the offer and answer.
+//
+// This binds the certificates WebRTC uses to the PAKE session, and makes a
+// peer on the wrong slot, or with a different idea of the protocol version,
+// fail the handshake explicitly.
+//
+// The MACs are carried as extra fields in the JSON of the session
+// descriptions, which version 4 peers ignore. A version 5 peer talking to a
+// version 4 peer sees no MAC and falls back to version 4 behaviour.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ErrBadFingerprint is returned when the certificate the remote peer uses for
+// DTLS does not match any fingerprint in its authenticated session description.
+var ErrBadFingerprint = errors.New("bad certificate fingerprint")
+
+// sessionDescription is a webrtc.SessionDescription with the fields version 5
+// of the protocol adds.
+type sessionDescription struct {
+	webrtc.SessionDescription
+
+	// Protocol is the version of the protocol the sender speaks.
+	Protocol string `json:"protocol,omitempty"`
+	// Confirm is the sender's key confirmation MAC.
+	Confirm []byte `json:"confirm,omitempty"`
+}
+
+// confirmation holds the state needed to compute and check key confirmation
+// MACs for one handshake.
+type confirmation struct {
+	key        []byte
+	transcript []byte
+}
+
+// newConfirmation derives the key confirmation key from the PAKE secret mk,
+// and hashes the transcript of the handshake so far.
+func newConfirmation(mk []byte, proto, slot string, msgA, msgB []byte) (*confirmation, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte("key confirmation")), key)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	for _, p := range [][]byte{[]byte(proto), []byte(slot), msgA, msgB} {
+		binary.Write(h, binary.BigEndian, uint32(len(p)))
+		h.Write(p)
+	}
+	return &confirmation{key: key, transcript: h.Sum(nil)}, nil
+}
+
+// mac returns the MAC for role ("offer" or "answer") over the transcript and
+// the DTLS fingerprints in sdps.
+func (kc *confirmation) mac(role string, sdps ...string) []byte {
+	m := hmac.New(sha256.New, kc.key)
+	fmt.Fprintf(m, "%s\n", role)
+	m.Write(kc.transcript)
+	for _, sdp := range sdps {
+		for _, fp := range sdpFingerprints(sdp) {
+			fmt.Fprintf(m, "\n%s %s", fp.algorithm, fp.value)
+		}
+	}
+	return m.Sum(nil)
+}
+
+// verify checks the MAC a peer sent for role.
+func (kc *confirmation) verify(mac []byte, role string, sdps ...string) error {
+	if !hmac.Equal(mac, kc.mac(role, sdps...)) {
+		return ErrBadKey
+	}
+	return nil
+}
+
+// sdpFingerprint is an a=fingerprint attribute of a session description.
+type sdpFingerprint struct {
+	algorithm string
+	value     string
+}
+
+// sdpFingerprints returns the DTLS certificate fingerprints in sdp, in the
+// order they appear.
+func sdpFingerprints(sdp string) []sdpFingerprint {
+	var fps []sdpFingerprint
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=fingerprint:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "a=fingerprint:"))
+		if len(fields) != 2 {
+			continue
+		}
+		fps = append(fps, sdpFingerprint{
+			algorithm: strings.ToLower(fields[0]),
+			value:     strings.ToUpper(fields[1]),
+		})
+	}
+	return fps
+}
+
+// fingerprintHashes are the hash functions for fingerprint algorithms we can
+// check.
+var fingerprintHashes = map[string]func() hash.Hash{
+	"sha-1":   sha1.New,
+	"sha-256": sha256.New,
+	"sha-384": sha512.New384,
+	"sha-512": sha512.New,
+}
+
+// certificateFingerprint formats the fingerprint of the DER encoded cert as
+// it appears in session descriptions.
+func certificateFingerprint(newHash func() hash.Hash, cert []byte) string {
+	h := newHash()
+	h.Write(cert)
+	var b bytes.Buffer
+	for i, x := range h.Sum(nil) {
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		fmt.Fprintf(&b, "%02X", x)
+	}
+	return b.String()
+}
+
+// verifyRemoteCertificate checks that the certificate the remote peer used
+// for DTLS matches a fingerprint in the remote session description, which
+// came over the PAKE-authenticated channel.
+func (c *Wormhole) verifyRemoteCertificate() error {
+	sctp := c.pc.SCTP()
+	desc := c.pc.RemoteDescription()
+	if sctp == nil || sctp.Transport() == nil || desc == nil {
+		return ErrBadFingerprint
+	}
+	cert := sctp.Transport().GetRemoteCertificate()
+	if len(cert) == 0 {
+		return ErrBadFingerprint
+	}
+	for _, fp := range sdpFingerprints(desc.SDP) {
+		newHash, ok := fingerprintHashes[fp.algorithm]
+		if !ok {
+			continue
+		}
+		if certificateFingerprint(newHash, cert) == fp.value {
+			return nil
+		}
+	}
+	return ErrBadFingerprint
+}
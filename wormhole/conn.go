@@ -0,0 +1,109 @@
+package wormhole
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// Wormhole implements net.Conn so that it can be used with packages that
+// expect one, like crypto/tls or net/http.
+var _ net.Conn = (*Wormhole)(nil)
+
+// readDeadliner is implemented by detached DataChannels.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// LocalAddr returns the local address of the selected ICE candidate pair.
+func (c *Wormhole) LocalAddr() net.Addr {
+	pair := c.candidatePair()
+	if pair == nil {
+		return candidateAddr(nil)
+	}
+	return candidateAddr(pair.Local)
+}
+
+// RemoteAddr returns the remote address of the selected ICE candidate pair.
+// If the connection is relayed, this is the address of the relay.
+func (c *Wormhole) RemoteAddr() net.Addr {
+	pair := c.candidatePair()
+	if pair == nil {
+		return candidateAddr(nil)
+	}
+	return candidateAddr(pair.Remote)
+}
+
+// CandidateTypes returns the types of the local and remote ICE candidates of
+// the selected pair, like "host", "srflx" or "relay". They are empty if no
+// pair has been selected.
+func (c *Wormhole) CandidateTypes() (local, remote string) {
+	pair := c.candidatePair()
+	if pair == nil || pair.Local == nil || pair.Remote == nil {
+		return "", ""
+	}
+	return pair.Local.Typ.String(), pair.Remote.Typ.String()
+}
+
+// candidatePair returns the selected ICE candidate pair, or nil if there is
+// none yet.
+func (c *Wormhole) candidatePair() *webrtc.ICECandidatePair {
+	sctp := c.pc.SCTP()
+	if sctp == nil || sctp.Transport() == nil || sctp.Transport().ICETransport() == nil {
+		return nil
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return nil
+	}
+	return pair
+}
+
+// iceAddr is the address of an ICE candidate that is not an IP address,
+// like an mDNS host name.
+type iceAddr struct {
+	network string
+	address string
+}
+
+func (a iceAddr) Network() string { return a.network }
+func (a iceAddr) String() string  { return a.address }
+
+// candidateAddr converts the address of candidate into a *net.UDPAddr or a
+// *net.TCPAddr, depending on the candidate's protocol.
+func candidateAddr(candidate *webrtc.ICECandidate) net.Addr {
+	if candidate == nil {
+		return iceAddr{network: "udp"}
+	}
+	ip := net.ParseIP(candidate.Address)
+	switch {
+	case candidate.Protocol == webrtc.ICEProtocolTCP && ip != nil:
+		return &net.TCPAddr{IP: ip, Port: int(candidate.Port)}
+	case candidate.Protocol == webrtc.ICEProtocolTCP:
+		return iceAddr{"tcp", net.JoinHostPort(candidate.Address, strconv.Itoa(int(candidate.Port)))}
+	case ip != nil:
+		return &net.UDPAddr{IP: ip, Port: int(candidate.Port)}
+	default:
+		return iceAddr{"udp", net.JoinHostPort(candidate.Address, strconv.Itoa(int(candidate.Port)))}
+	}
+}
+
+// SetDeadline sets the read and write deadlines of the default DataChannel.
+func (c *Wormhole) SetDeadline(t time.Time) error {
+	return c.data.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+// A zero t means Read will not time out.
+func (c *Wormhole) SetReadDeadline(t time.Time) error {
+	return c.data.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for pending and future Write calls,
+// including those waiting for the DataChannel's buffers to drain.
+// A zero t means Write will not time out.
+func (c *Wormhole) SetWriteDeadline(t time.Time) error {
+	return c.data.SetWriteDeadline(t)
+}
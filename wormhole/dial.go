@@ -13,7 +13,8 @@
 //
 // The protocol requires a signalling server that facilitates exchanging
 // arbitrary messages via a slot system. The server subcommand of the
-// ww tool is an implementation of this over WebSockets.
+// ww tool is an implementation of this over WebSockets. Other ways of
+// exchanging the messages can be plugged in by implementing Signaller.
 //
 // Rough sketch of the handshake:
 //
@@ -24,8 +25,8 @@
 //	                            | ------------TURN_ticket--->
 //	<---------------------------|--------------pake_msg_a----
 //	----pake_msg_b--------------|--------------------------->
-//	----sbox(offer)-------------|--------------------------->
-//	<---------------------------|------------sbox(answer)----
+//	----sbox(offer,mac_b)-------|--------------------------->
+//	<---------------------------|------sbox(answer,mac_a)----
 //	----sbox(candidates...)-----|--------------------------->
 //	<---------------------------|-----sbox(candidates...)----
 package wormhole
@@ -39,7 +40,6 @@ import (
 	"errors"
 	"io"
 	"log"
-	"net/url"
 	"sync"
 	"time"
 
@@ -47,14 +47,18 @@ import (
 	webrtc "github.com/pion/webrtc/v3"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
-	"golang.org/x/net/proxy"
-	"nhooyr.io/websocket"
 )
 
 // Protocol is an identifier for the current signalling scheme. It's
 // intended to help clients print a friendlier message urging them to
 // upgrade if the signalling server has a different version.
-const Protocol = "4"
+const Protocol = "5"
+
+// Protocols lists the versions of the signalling protocol this package can
+// speak, most preferred first. The messages of versions 4 and 5 are the same
+// shape, so peers of either version can complete a handshake with each other,
+// without key confirmation.
+var Protocols = []string{Protocol, "4"}
 
 const (
 	// CloseNoSuchSlot is the WebSocket status returned if the slot is not valid.
@@ -92,6 +96,26 @@ const (
 
 	// CloseWebRTCFailed we couldn't establish a WebRTC connection.
 	CloseWebRTCFailed
+
+	// CloseServerDraining is the WebSocket status returned to clients waiting
+	// on a slot, or asking for one, when the signalling server is shutting
+	// down. They can try again, and will likely reach a server that isn't.
+	CloseServerDraining
+
+	// CloseThrottled is the WebSocket status returned when the signalling
+	// server turns a client away for asking for, or trying to join, too
+	// many slots.
+	CloseThrottled
+)
+
+const (
+	// drainRetries is how many times RetryDrained tries again after the
+	// signalling server shuts down.
+	drainRetries = 8
+
+	// maxDrainBackoff is the longest RetryDrained waits before trying
+	// again.
+	maxDrainBackoff = 16 * time.Second
 )
 
 var (
@@ -108,11 +132,26 @@ var (
 
 	// ErrTimedOut indicates signalling has timed out.
 	ErrTimedOut = errors.New("timed out")
+
+	// ErrNotFlushed is returned by Close when the remote peer stops
+	// acknowledging what was written before all of it is. The rest of it
+	// is lost.
+	ErrNotFlushed = errors.New("closed before everything written was acknowledged")
+
+	// errDecrypt is returned for an encrypted message too short to be one,
+	// like one cut short when pasted by hand.
+	errDecrypt = errors.New("cannot decrypt malformed message")
 )
 
-// Verbose logging.
+// Verbose logging, used when a wormhole's Config has no Logger.
 var Verbose = false
 
+// ConnectTimeout is the maximum amount of time to wait for the WebRTC
+// connection to be established once the offer and answer have been
+// exchanged, used when a wormhole's Config does not set one. Zero means
+// no timeout.
+var ConnectTimeout = 30 * time.Second
+
 func logf(format string, v ...interface{}) {
 	if Verbose {
 		log.Printf(format, v...)
@@ -123,87 +162,64 @@ func logf(format string, v ...interface{}) {
 // protocol. It is wraps webrtc.PeerConnection and webrtc.DataChannel.
 //
 // BUG(s): A PeerConnection established via Wormhole will always have a DataChannel
-// created for it, with the name "data" and id 0.
+// created for it, with the name "data" and id 0. Read and Write use it, and
+// any other streams are opened with OpenStream and AcceptStream.
 type Wormhole struct {
-	rwc io.ReadWriteCloser
-	d   *webrtc.DataChannel
 	pc  *webrtc.PeerConnection
-
-	// opened signals that the underlying DataChannel is open and ready
-	// to handle data.
-	opened chan struct{}
-	// err forwards errors from the OnError callback.
-	err chan error
-	// flushc is a condition variable to coordinate flushed state of the
-	// underlying channel.
-	flushc *sync.Cond
+	cfg Config
+
+	// data is the default stream, created during the handshake.
+	data *Stream
+
+	// fp is the fingerprint of the key agreed by PAKE.
+	fp []byte
+	// confirmed is whether both peers confirmed the key agreed by PAKE,
+	// which they do if they both speak version 5 of the protocol.
+	confirmed bool
+
+	// accept queues streams opened by the remote peer.
+	accept chan *Stream
+	// closed is closed by Close, after which no more streams are accepted.
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-// Read writes a message to the default DataChannel.
+// Write writes a message to the default DataChannel.
 func (c *Wormhole) Write(p []byte) (n int, err error) {
-	// The webrtc package's channel does not have a blocking Write, so
-	// we can't just use io.Copy until the issue is fixed upsteam.
-	// Work around this by blocking here and waiting for flushes.
-	// https://github.com/pion/sctp/issues/77
-	c.flushc.L.Lock()
-	for c.d.BufferedAmount() > c.d.BufferedAmountLowThreshold() {
-		c.flushc.Wait()
-	}
-	c.flushc.L.Unlock()
-	return c.rwc.Write(p)
+	return c.data.Write(p)
 }
 
 // Read read a message from the default DataChannel.
 func (c *Wormhole) Read(p []byte) (n int, err error) {
-	return c.rwc.Read(p)
-}
-
-// TODO benchmark this buffer madness.
-func (c *Wormhole) flushed() {
-	c.flushc.L.Lock()
-	c.flushc.Signal()
-	c.flushc.L.Unlock()
+	return c.data.Read(p)
 }
 
 // Close attempts to flush the DataChannel buffers then close it
-// and its PeerConnection.
+// and its PeerConnection. If the remote peer stops acknowledging what is
+// in the buffers, it gives up and returns ErrNotFlushed.
 func (c *Wormhole) Close() (err error) {
-	logf("closing")
-	for c.d.BufferedAmount() != 0 {
-		// SetBufferedAmountLowThreshold does not seem to take effect
-		// when after the last Write().
-		time.Sleep(time.Second) // eww.
-	}
-	tryclose := func(c io.Closer) {
-		e := c.Close()
-		if e != nil {
-			err = e
-		}
+	c.cfg.logf("closing")
+	c.closeOnce.Do(func() { close(c.closed) })
+	err = c.data.Close()
+	if e := c.pc.Close(); e != nil {
+		err = e
 	}
-	defer tryclose(c.pc)
-	defer tryclose(c.d)
-	defer tryclose(c.rwc)
-	return nil
+	return err
 }
 
-func (c *Wormhole) open() {
-	var err error
-	c.rwc, err = c.d.Detach()
-	if err != nil {
-		c.err <- err
-		return
+func newWormhole(cfg *Config) *Wormhole {
+	c := &Wormhole{
+		accept: make(chan *Stream),
+		closed: make(chan struct{}),
 	}
-	close(c.opened)
-}
-
-// It's not really clear to me when this will be invoked.
-func (c *Wormhole) error(err error) {
-	log.Printf("debug: %v", err)
-	c.err <- err
+	if cfg != nil {
+		c.cfg = *cfg
+	}
+	return c
 }
 
-func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
-	_, buf, err := ws.Read(context.TODO())
+func readEncJSON(ctx context.Context, sig Signaller, key *[32]byte, v interface{}) error {
+	buf, err := sig.Receive(ctx)
 	if err != nil {
 		return err
 	}
@@ -211,6 +227,9 @@ func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
 	if err != nil {
 		return err
 	}
+	if len(encrypted) < 24 {
+		return errDecrypt
+	}
 	var nonce [24]byte
 	copy(nonce[:], encrypted[:24])
 	jsonmsg, ok := secretbox.Open(nil, encrypted[24:], &nonce, key)
@@ -220,7 +239,7 @@ func readEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
 	return json.Unmarshal(jsonmsg, v)
 }
 
-func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
+func writeEncJSON(ctx context.Context, sig Signaller, key *[32]byte, v interface{}) error {
 	jsonmsg, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -229,104 +248,175 @@ func writeEncJSON(ws *websocket.Conn, key *[32]byte, v interface{}) error {
 	if _, err := io.ReadFull(crand.Reader, nonce[:]); err != nil {
 		return err
 	}
-	return ws.Write(
-		context.TODO(),
-		websocket.MessageText,
+	return sig.Send(
+		ctx,
 		[]byte(base64.URLEncoding.EncodeToString(
 			secretbox.Seal(nonce[:], jsonmsg, &nonce, key),
 		)),
 	)
 }
 
-func readBase64(ws *websocket.Conn) ([]byte, error) {
-	_, buf, err := ws.Read(context.TODO())
+func readBase64(ctx context.Context, sig Signaller) ([]byte, error) {
+	buf, err := sig.Receive(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return base64.URLEncoding.DecodeString(string(buf))
 }
 
-func writeBase64(ws *websocket.Conn, p []byte) error {
-	return ws.Write(
-		context.TODO(),
-		websocket.MessageText,
-		[]byte(base64.URLEncoding.EncodeToString(p)),
-	)
-}
-
-// readInitMsg reads the first message the signalling server sends over
-// the WebSocket connection, which has metadata includign assigned slot
-// and ICE servers to use.
-func readInitMsg(ws *websocket.Conn) (slot string, iceServers []webrtc.ICEServer, err error) {
-	msg := struct {
-		Slot       string             `json:"slot",omitempty`
-		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
-	}{}
-
-	_, buf, err := ws.Read(context.TODO())
-	if err != nil {
-		return "", nil, err
-	}
-	err = json.Unmarshal(buf, &msg)
-	return msg.Slot, msg.ICEServers, err
+func writeBase64(ctx context.Context, sig Signaller, p []byte) error {
+	return sig.Send(ctx, []byte(base64.URLEncoding.EncodeToString(p)))
 }
 
 // handleRemoteCandidates waits for remote candidate to trickle in. We close
-// the websocket when we get a successful connection so this should fail and
+// the signaller when we get a successful connection so this should fail and
 // exit at some point.
-func (c *Wormhole) handleRemoteCandidates(ws *websocket.Conn, key *[32]byte) {
+func (c *Wormhole) handleRemoteCandidates(ctx context.Context, sig Signaller, key *[32]byte) {
 	for {
 		var candidate webrtc.ICECandidateInit
-		err := readEncJSON(ws, key, &candidate)
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+		err := readEncJSON(ctx, sig, key, &candidate)
+		if closeStatus(err) == closeNormal {
 			return
 		}
 		if err != nil {
-			logf("cannot read remote candidate: %v", err)
+			c.cfg.logf("cannot read remote candidate: %v", err)
 			return
 		}
-		logf("received new remote candidate: %v", candidate.Candidate)
+		c.cfg.logf("received new remote candidate: %v", candidate.Candidate)
 		err = c.pc.AddICECandidate(candidate)
 		if err != nil {
-			logf("cannot add candidate: %v", err)
+			c.cfg.logf("cannot add candidate: %v", err)
 			return
 		}
 	}
 }
 
+// sendLocalCandidates trickles local candidates to the remote peer as they
+// are gathered.
+func (c *Wormhole) sendLocalCandidates(ctx context.Context, sig Signaller, key *[32]byte) {
+	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		err := writeEncJSON(ctx, sig, key, candidate.ToJSON())
+		if closeStatus(err) == closeNormal {
+			return
+		}
+		if err != nil {
+			c.cfg.logf("cannot send local candidate: %v", err)
+			return
+		}
+		c.cfg.logf("sent new local candidate: %v", candidate.String())
+	})
+}
+
+// gather sets desc as the local description and waits for ICE gathering to
+// complete. It returns the local description, which then includes all the
+// local candidates.
+func (c *Wormhole) gather(ctx context.Context, desc webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	done := webrtc.GatheringCompletePromise(c.pc)
+	err := c.pc.SetLocalDescription(desc)
+	if err != nil {
+		return desc, err
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return desc, ctx.Err()
+	}
+	c.cfg.logf("gathered local candidates")
+	return *c.pc.LocalDescription(), nil
+}
+
 func (c *Wormhole) newPeerConnection(ice []webrtc.ICEServer) error {
-	// Accessing pion/webrtc APIs like DataChannel.Detach() requires
-	// that we do this voodoo.
-	s := webrtc.SettingEngine{}
-	s.DetachDataChannels()
-	s.SetICEProxyDialer(proxy.FromEnvironment())
-	rtcapi := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+	rtcapi := webrtc.NewAPI(webrtc.WithSettingEngine(c.cfg.settingEngine()))
 
 	var err error
 	c.pc, err = rtcapi.NewPeerConnection(webrtc.Configuration{
-		ICEServers: ice,
+		ICEServers: c.cfg.iceServers(ice),
 	})
 	if err != nil {
 		return err
 	}
 
 	sigh := true
-	c.d, err = c.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
+	d, err := c.pc.CreateDataChannel(c.cfg.label(), &webrtc.DataChannelInit{
 		Negotiated: &sigh,
 		ID:         new(uint16),
 	})
 	if err != nil {
 		return err
 	}
-	c.d.OnOpen(c.open)
-	c.d.OnError(c.error)
-	c.d.OnBufferedAmountLow(c.flushed)
-	// Any threshold amount >= 1MiB seems to occasionally lock up pion.
-	// Choose 512 KiB as a safe default.
-	c.d.SetBufferedAmountLowThreshold(512 << 10)
+	c.data = newStream(d, &c.cfg)
+	c.pc.OnDataChannel(c.handleDataChannel)
 	return nil
 }
 
+// wait blocks until the DataChannel opens, fails, the connection times
+// out, or ctx is done, then reports the outcome to the signalling server
+// and closes the signalling channel.
+func (c *Wormhole) wait(ctx context.Context, sig Signaller) error {
+	var timeout <-chan time.Time
+	if d := c.cfg.connectTimeout(); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-c.data.opened:
+		if err := c.verifyRemoteCertificate(); err != nil {
+			sig.Close(CloseWebRTCFailed, "bad fingerprint")
+			return err
+		}
+		relay := c.IsRelay()
+		c.cfg.logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
+		if relay {
+			sig.Close(CloseWebRTCSuccessRelay, "")
+		} else {
+			sig.Close(CloseWebRTCSuccessDirect, "")
+		}
+		return nil
+	case err := <-c.data.err:
+		sig.Close(CloseWebRTCFailed, "")
+		return err
+	case <-timeout:
+		sig.Close(CloseWebRTCFailed, "timed out")
+		return ErrTimedOut
+	case <-ctx.Done():
+		sig.Close(CloseWebRTCFailed, "cancelled")
+		return ctx.Err()
+	}
+}
+
+// abort tears down a failed handshake. It closes the signaller and the
+// PeerConnection, if one was created, and returns ctx.Err() in place of err
+// if ctx is done.
+func (c *Wormhole) abort(ctx context.Context, sig Signaller, err error) error {
+	sig.Close(closeNormal, "")
+	if c.pc != nil {
+		c.pc.Close()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// fingerprint derives a short fingerprint from the key agreed by PAKE. It's
+// the same as the one the web client derives and displays.
+func fingerprint(key *[32]byte) ([]byte, error) {
+	fp := make([]byte, 8)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key[:], nil, []byte("fingerprint")), fp)
+	return fp, err
+}
+
+// Fingerprint returns a short fingerprint of the key agreed by PAKE. Both
+// peers derive the same fingerprint, so comparing them out of band detects
+// an attacker that guessed the password and is relaying the connection.
+func (c *Wormhole) Fingerprint() []byte {
+	return c.fp
+}
+
 // IsRelay returns whether this connection is over a TURN relay or not.
 func (c *Wormhole) IsRelay() bool {
 	stats := c.pc.GetStats()
@@ -363,128 +453,214 @@ func (c *Wormhole) IsRelay() bool {
 //
 // The server generated slot identifier is written on slotc.
 //
+// If the signalling server shuts down before the remote peer joins, New
+// starts over on a new slot, as Accept does with Config.RetryDraining.
+//
 // If pc is nil it initialises ones using the default STUN server.
 func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
-	c := &Wormhole{
-		opened: make(chan struct{}),
-		err:    make(chan error),
-		flushc: sync.NewCond(&sync.Mutex{}),
-	}
+	return NewContext(context.Background(), pass, sigserv, slotc)
+}
 
-	u, err := url.Parse(sigserv)
-	if err != nil {
-		return nil, err
+// NewContext is like New, but aborts the handshake if ctx is done before
+// the WebRTC connection is established. In that case the PeerConnection
+// is closed and ctx.Err() is returned.
+func NewContext(ctx context.Context, pass string, sigserv string, slotc chan string) (*Wormhole, error) {
+	return Accept(ctx, pass, sigserv, slotc, &Config{RetryDraining: true})
+}
+
+// Accept is like NewContext, but configures the wormhole using cfg. A nil
+// cfg uses the defaults.
+//
+// If cfg has RetryDraining set and the signalling server shuts down before
+// the remote peer joins, Accept waits a little and starts over on a new
+// slot. Only the first slot is written on slotc as AcceptSignaller does.
+// Later ones are written without blocking, so that callers that read one
+// slot are not held up, and are dropped unless slotc has room for them or
+// the caller is waiting on it.
+func Accept(ctx context.Context, pass string, sigserv string, slotc chan string, cfg *Config) (*Wormhole, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	first := true
+	accept := func() (*Wormhole, error) {
+		sig, err := DialWebSocket(ctx, sigserv, "", cfg)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			first = false
+			return AcceptSignaller(ctx, pass, sig, slotc, cfg)
+		}
+		if slotc != nil {
+			slot, _ := sig.Slot()
+			select {
+			case slotc <- slot:
+			default:
+				cfg.logf("dropping slot %v: nobody is reading slotc", slot)
+			}
+		}
+		return AcceptSignaller(ctx, pass, sig, nil, cfg)
 	}
-	if u.Scheme == "http" || u.Scheme == "ws" {
-		u.Scheme = "ws"
-	} else {
-		u.Scheme = "wss"
+	if !cfg.RetryDraining {
+		return accept()
 	}
-	wsaddr := u.String()
+	return RetryDrained(ctx, cfg, accept)
+}
 
-	ws, _, err := websocket.Dial(context.TODO(), wsaddr, &websocket.DialOptions{
-		Subprotocols: []string{Protocol},
-	})
-	if err != nil {
-		return nil, err
+// RetryDrained calls accept, and calls it again, waiting longer each time,
+// for as long as it fails because the signalling server is shutting down.
+// accept should start a new handshake on a new slot each time. A nil cfg
+// uses the defaults.
+func RetryDrained(ctx context.Context, cfg *Config, accept func() (*Wormhole, error)) (*Wormhole, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	backoff := time.Second
+	for retries := 0; ; retries++ {
+		c, err := accept()
+		if err == nil {
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if closeStatus(err) != CloseServerDraining || retries == drainRetries {
+			return nil, err
+		}
+		cfg.logf("signalling server is shutting down, trying again in %v", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxDrainBackoff {
+			backoff = maxDrainBackoff
+		}
 	}
+}
 
-	assignedSlot, iceServers, err := readInitMsg(ws)
-	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
-	}
+// AcceptSignaller is like Accept, but runs the handshake over sig instead of
+// a WebSocket signalling server. The slot sig reports is written on slotc,
+// unless slotc is nil. The handshake closes sig when it's done.
+func AcceptSignaller(ctx context.Context, pass string, sig Signaller, slotc chan string, cfg *Config) (*Wormhole, error) {
+	c := newWormhole(cfg)
+	err := c.new(ctx, pass, sig, slotc)
 	if err != nil {
-		return nil, err
+		return nil, c.abort(ctx, sig, err)
+	}
+	return c, nil
+}
+
+func (c *Wormhole) new(ctx context.Context, pass string, sig Signaller, slotc chan string) error {
+	assignedSlot, iceServers := sig.Slot()
+	c.cfg.logf("connected to signalling server, got slot: %v", assignedSlot)
+	if slotc != nil {
+		select {
+		case slotc <- assignedSlot:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	logf("connected to signalling server, got slot: %v", assignedSlot)
-	slotc <- assignedSlot
-	err = c.newPeerConnection(iceServers)
+	err := c.newPeerConnection(iceServers)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	msgA, err := readBase64(ws)
+	msgA, err := readBase64(ctx, sig)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("got A pake msg (%v bytes)", len(msgA))
+	c.cfg.logf("got A pake msg (%v bytes)", len(msgA))
 
 	msgB, mk, err := cpace.Exchange(pass, cpace.NewContextInfo("", "", nil), msgA)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	key := [32]byte{}
 	_, err = io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:])
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = writeBase64(ws, msgB)
+	c.fp, err = fingerprint(&key)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("have key, sent B pake msg (%v bytes)", len(msgB))
-
-	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
-		}
-		err := writeEncJSON(ws, &key, candidate.ToJSON())
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-			return
-		}
+	var kc *confirmation
+	if c.cfg.protocol() != "4" {
+		kc, err = newConfirmation(mk, Protocol, assignedSlot, msgA, msgB)
 		if err != nil {
-			logf("cannot send local candidate: %v", err)
-			return
+			return err
 		}
-		logf("sent new local candidate: %v", candidate.String())
-	})
+	}
+	err = writeBase64(ctx, sig, msgB)
+	if err != nil {
+		return err
+	}
+	c.cfg.logf("have key, sent B pake msg (%v bytes)", len(msgB))
+
+	if !c.cfg.NoTrickle {
+		c.sendLocalCandidates(ctx, sig, &key)
+	}
 
 	offer, err := c.pc.CreateOffer(nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = writeEncJSON(ws, &key, offer)
-	if err != nil {
-		return nil, err
+	if c.cfg.NoTrickle {
+		offer, err = c.gather(ctx, offer)
+		if err != nil {
+			return err
+		}
 	}
-	err = c.pc.SetLocalDescription(offer)
+	sealedOffer := sessionDescription{SessionDescription: offer}
+	if kc != nil {
+		sealedOffer.Protocol = Protocol
+		sealedOffer.Confirm = kc.mac("offer", offer.SDP)
+	}
+	err = writeEncJSON(ctx, sig, &key, sealedOffer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("sent offer")
+	if !c.cfg.NoTrickle {
+		err = c.pc.SetLocalDescription(offer)
+		if err != nil {
+			return err
+		}
+	}
+	c.cfg.logf("sent offer")
 
-	var answer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &answer)
-	if websocket.CloseStatus(err) == CloseBadKey {
-		return nil, ErrBadKey
+	var answer sessionDescription
+	err = readEncJSON(ctx, sig, &key, &answer)
+	if closeStatus(err) == CloseBadKey {
+		return ErrBadKey
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = c.pc.SetRemoteDescription(answer)
+	switch {
+	case kc != nil && answer.Confirm != nil:
+		err = kc.verify(answer.Confirm, "answer", offer.SDP, answer.SDP)
+		if err != nil {
+			sig.Close(CloseBadKey, "bad key")
+			return err
+		}
+		c.confirmed = true
+		c.cfg.logf("peer confirmed key")
+	case kc != nil:
+		c.cfg.logf("peer does not support key confirmation")
+	}
+	err = c.pc.SetRemoteDescription(answer.SessionDescription)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("got answer")
-
-	go c.handleRemoteCandidates(ws, &key)
+	c.cfg.logf("got answer")
 
-	select {
-	case <-c.opened:
-		relay := c.IsRelay()
-		logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
-		if relay {
-			ws.Close(CloseWebRTCSuccessRelay, "")
-		} else {
-			ws.Close(CloseWebRTCSuccessDirect, "")
-		}
-	case err = <-c.err:
-		ws.Close(CloseWebRTCFailed, "")
-	case <-time.After(30 * time.Second):
-		err = ErrTimedOut
-		ws.Close(CloseWebRTCFailed, "timed out")
+	if !c.cfg.NoTrickle {
+		go c.handleRemoteCandidates(ctx, sig, &key)
 	}
-	return c, err
+
+	return c.wait(ctx, sig)
 }
 
 // Join performs the signalling handshake to join an existing slot.
@@ -495,43 +671,47 @@ func New(pass string, sigserv string, slotc chan string) (*Wormhole, error) {
 //
 // If pc is nil it initialises ones using the default STUN server.
 func Join(slot, pass string, sigserv string) (*Wormhole, error) {
-	c := &Wormhole{
-		opened: make(chan struct{}),
-		err:    make(chan error),
-		flushc: sync.NewCond(&sync.Mutex{}),
-	}
+	return JoinContext(context.Background(), slot, pass, sigserv)
+}
 
-	u, err := url.Parse(sigserv)
-	if err != nil {
-		return nil, err
-	}
-	if u.Scheme == "http" || u.Scheme == "ws" {
-		u.Scheme = "ws"
-	} else {
-		u.Scheme = "wss"
-	}
-	u.Path += slot
-	wsaddr := u.String()
+// JoinContext is like Join, but aborts the handshake if ctx is done before
+// the WebRTC connection is established. In that case the PeerConnection
+// is closed and ctx.Err() is returned.
+func JoinContext(ctx context.Context, slot, pass string, sigserv string) (*Wormhole, error) {
+	return Dial(ctx, slot, pass, sigserv, nil)
+}
 
-	// Start the handshake.
-	ws, _, err := websocket.Dial(context.TODO(), wsaddr, &websocket.DialOptions{
-		Subprotocols: []string{Protocol},
-	})
+// Dial is like JoinContext, but configures the wormhole using cfg. A nil
+// cfg uses the defaults.
+func Dial(ctx context.Context, slot, pass string, sigserv string, cfg *Config) (*Wormhole, error) {
+	sig, err := DialWebSocket(ctx, sigserv, slot, cfg)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
+	return DialSignaller(ctx, pass, sig, cfg)
+}
 
-	_, iceServers, err := readInitMsg(ws)
-	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
-	}
+// DialSignaller is like Dial, but runs the handshake over sig, which must
+// already be on the slot to join, instead of a WebSocket signalling server.
+// The handshake closes sig when it's done.
+func DialSignaller(ctx context.Context, pass string, sig Signaller, cfg *Config) (*Wormhole, error) {
+	c := newWormhole(cfg)
+	err := c.join(ctx, pass, sig)
 	if err != nil {
-		return nil, err
+		return nil, c.abort(ctx, sig, err)
 	}
-	logf("connected to signalling server on slot: %v", slot)
-	err = c.newPeerConnection(iceServers)
+	return c, nil
+}
+
+func (c *Wormhole) join(ctx context.Context, pass string, sig Signaller) error {
+	slot, iceServers := sig.Slot()
+	c.cfg.logf("connected to signalling server on slot: %v", slot)
+	err := c.newPeerConnection(iceServers)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// The identity arguments are to bind endpoint identities in PAKE. Cf. Unknown
@@ -546,93 +726,103 @@ func Join(slot, pass string, sigserv string) (*Wormhole, error) {
 
 	msgA, pake, err := cpace.Start(pass, cpace.NewContextInfo("", "", nil))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = writeBase64(ws, msgA)
+	err = writeBase64(ctx, sig, msgA)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("sent A pake msg (%v bytes)", len(msgA))
+	c.cfg.logf("sent A pake msg (%v bytes)", len(msgA))
 
-	msgB, err := readBase64(ws)
-	if websocket.CloseStatus(err) == CloseWrongProto {
-		return nil, ErrBadVersion
+	msgB, err := readBase64(ctx, sig)
+	if closeStatus(err) == CloseWrongProto {
+		return ErrBadVersion
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 	mk, err := pake.Finish(msgB)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	key := [32]byte{}
 	_, err = io.ReadFull(hkdf.New(sha256.New, mk, nil, nil), key[:])
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("have key, got B msg (%v bytes)", len(msgB))
+	c.fp, err = fingerprint(&key)
+	if err != nil {
+		return err
+	}
+	c.cfg.logf("have key, got B msg (%v bytes)", len(msgB))
 
-	var offer webrtc.SessionDescription
-	err = readEncJSON(ws, &key, &offer)
+	var offer sessionDescription
+	err = readEncJSON(ctx, sig, &key, &offer)
 	if err == ErrBadKey {
 		// Close with the right status so the other side knows to quit immediately.
-		ws.Close(CloseBadKey, "bad key")
-		return nil, err
+		sig.Close(CloseBadKey, "bad key")
+		return err
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	c.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			return
-		}
-		err := writeEncJSON(ws, &key, candidate.ToJSON())
-		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
-			return
+	var kc *confirmation
+	switch {
+	case c.cfg.protocol() != "4" && offer.Confirm != nil:
+		kc, err = newConfirmation(mk, Protocol, slot, msgA, msgB)
+		if err != nil {
+			return err
 		}
+		err = kc.verify(offer.Confirm, "offer", offer.SDP)
 		if err != nil {
-			logf("cannot send local candidate: %v", err)
-			return
+			sig.Close(CloseBadKey, "bad key")
+			return err
 		}
-		logf("sent new local candidate: %v", candidate.String())
-	})
+		c.confirmed = true
+		c.cfg.logf("peer confirmed key")
+	case c.cfg.protocol() != "4":
+		c.cfg.logf("peer does not support key confirmation")
+	}
 
-	err = c.pc.SetRemoteDescription(offer)
+	if !c.cfg.NoTrickle {
+		c.sendLocalCandidates(ctx, sig, &key)
+	}
+
+	err = c.pc.SetRemoteDescription(offer.SessionDescription)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("got offer")
+	c.cfg.logf("got offer")
 	answer, err := c.pc.CreateAnswer(nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	err = writeEncJSON(ws, &key, answer)
-	if err != nil {
-		return nil, err
+	if c.cfg.NoTrickle {
+		answer, err = c.gather(ctx, answer)
+		if err != nil {
+			return err
+		}
 	}
-	err = c.pc.SetLocalDescription(answer)
+	sealedAnswer := sessionDescription{SessionDescription: answer}
+	if kc != nil {
+		sealedAnswer.Protocol = Protocol
+		sealedAnswer.Confirm = kc.mac("answer", offer.SDP, answer.SDP)
+	}
+	err = writeEncJSON(ctx, sig, &key, sealedAnswer)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	logf("sent answer")
-
-	go c.handleRemoteCandidates(ws, &key)
-
-	select {
-	case <-c.opened:
-		relay := c.IsRelay()
-		logf("webrtc connection succeeded (relay: %v) closing signalling channel", relay)
-		if relay {
-			ws.Close(CloseWebRTCSuccessRelay, "")
-		} else {
-			ws.Close(CloseWebRTCSuccessDirect, "")
+	if !c.cfg.NoTrickle {
+		err = c.pc.SetLocalDescription(answer)
+		if err != nil {
+			return err
 		}
-	case err = <-c.err:
-		ws.Close(CloseWebRTCFailed, "")
-	case <-time.After(30 * time.Second):
-		err = ErrTimedOut
-		ws.Close(CloseWebRTCFailed, "timed out")
 	}
-	return c, err
+	c.cfg.logf("sent answer")
+
+	if !c.cfg.NoTrickle {
+		go c.handleRemoteCandidates(ctx, sig, &key)
+	}
+
+	return c.wait(ctx, sig)
 }
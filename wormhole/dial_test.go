@@ -0,0 +1,701 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+// testServer is a minimal signalling server. It pairs peers on slots and
+// relays messages between them like the one in ww server.
+type testServer struct {
+	mu    sync.Mutex
+	next  int
+	slots map[string]chan *websocket.Conn
+
+	// drain is how many peers waiting on new slots to turn away like a
+	// server that is shutting down.
+	drain int
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols: Protocols,
+	})
+	if err != nil {
+		return
+	}
+	ctx := r.Context()
+
+	slot := strings.TrimPrefix(r.URL.Path, "/")
+	creator := slot == ""
+	s.mu.Lock()
+	if creator {
+		s.next++
+		slot = strconv.Itoa(s.next)
+		s.slots[slot] = make(chan *websocket.Conn)
+	}
+	sc, ok := s.slots[slot]
+	s.mu.Unlock()
+	if !ok {
+		conn.Close(CloseNoSuchSlot, "no such slot")
+		return
+	}
+
+	buf, _ := json.Marshal(struct {
+		Slot string `json:"slot"`
+	}{slot})
+	if err := conn.Write(ctx, websocket.MessageText, buf); err != nil {
+		return
+	}
+	s.mu.Lock()
+	drain := creator && s.drain > 0
+	if drain {
+		s.drain--
+		delete(s.slots, slot)
+	}
+	s.mu.Unlock()
+	if drain {
+		conn.Close(CloseServerDraining, "server shutting down")
+		return
+	}
+
+	var peer *websocket.Conn
+	if creator {
+		peer = <-sc
+		sc <- conn
+	} else {
+		sc <- conn
+		peer = <-sc
+	}
+	for {
+		typ, p, err := conn.Read(ctx)
+		switch websocket.CloseStatus(err) {
+		case CloseBadKey:
+			peer.Close(CloseBadKey, "bad key")
+			return
+		case CloseWebRTCSuccess, CloseWebRTCSuccessDirect, CloseWebRTCSuccessRelay, CloseWebRTCFailed:
+			return
+		}
+		if err != nil {
+			peer.Close(ClosePeerHungUp, "peer hung up")
+			return
+		}
+		if err := peer.Write(ctx, typ, p); err != nil {
+			return
+		}
+	}
+}
+
+func newTestServer(t *testing.T) string {
+	srv := httptest.NewServer(&testServer{slots: make(map[string]chan *websocket.Conn)})
+	t.Cleanup(srv.Close)
+	return srv.URL + "/"
+}
+
+// testConfig returns a Config that speaks protocol version and can connect
+// over the loopback interface.
+func testConfig(version string) *Config {
+	return &Config{
+		version:            version,
+		OverrideICEServers: true,
+		SettingEngine: func(s *webrtc.SettingEngine) {
+			s.SetIncludeLoopbackCandidate(true)
+		},
+		ConnectTimeout: 10 * time.Second,
+	}
+}
+
+type dialResult struct {
+	c   *Wormhole
+	err error
+}
+
+// handshake connects two peers on sigserv. The peer creating the slot uses
+// password passA and protocol version versionA, the one joining it passB
+// and versionB.
+func handshake(t *testing.T, sigserv, passA, versionA, passB, versionB string) (a, b dialResult) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	slotc := make(chan string, 1)
+	resc := make(chan dialResult)
+	go func() {
+		c, err := Accept(ctx, passA, sigserv, slotc, testConfig(versionA))
+		resc <- dialResult{c, err}
+	}()
+	var slot string
+	select {
+	case slot = <-slotc:
+	case a = <-resc:
+		t.Fatalf("could not get slot: %v", a.err)
+	}
+	c, err := Dial(ctx, slot, passB, sigserv, testConfig(versionB))
+	b = dialResult{c, err}
+	a = <-resc
+	return a, b
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	sigserv := newTestServer(t)
+	cases := []struct {
+		a, b      string
+		confirmed bool
+	}{
+		{"5", "5", true},
+		{"5", "4", false},
+		{"4", "5", false},
+		{"4", "4", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.a+"-"+tc.b, func(t *testing.T) {
+			a, b := handshake(t, sigserv, "password", tc.a, "password", tc.b)
+			if a.err != nil || b.err != nil {
+				t.Fatalf("handshake failed: %v, %v", a.err, b.err)
+			}
+			// The writer closes first, so that the reader is still there
+			// to acknowledge what it wrote while its Close flushes it.
+			defer b.c.Close()
+			defer a.c.Close()
+
+			if a.c.confirmed != tc.confirmed || b.c.confirmed != tc.confirmed {
+				t.Errorf("got confirmed %v,%v want %v", a.c.confirmed, b.c.confirmed, tc.confirmed)
+			}
+			if string(a.c.Fingerprint()) != string(b.c.Fingerprint()) {
+				t.Errorf("fingerprints differ: %x, %x", a.c.Fingerprint(), b.c.Fingerprint())
+			}
+
+			go a.c.Write([]byte("hello"))
+			buf := make([]byte, 16)
+			n, err := b.c.Read(buf)
+			if err != nil && err != io.EOF {
+				t.Fatalf("could not read: %v", err)
+			}
+			if string(buf[:n]) != "hello" {
+				t.Errorf("got %q want %q", buf[:n], "hello")
+			}
+		})
+	}
+}
+
+func TestCloseUnflushed(t *testing.T) {
+	defer func(d time.Duration) { flushTimeout = d }(flushTimeout)
+	flushTimeout = 500 * time.Millisecond
+	sigserv := newTestServer(t)
+	for _, tc := range []struct {
+		name string
+		// readerFirst closes the reader before it acknowledges what it
+		// read, so the writer cannot flush it.
+		readerFirst bool
+		want        error
+	}{
+		{"writer first", false, nil},
+		{"reader first", true, ErrNotFlushed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := handshake(t, sigserv, "password", "", "password", "")
+			if a.err != nil || b.err != nil {
+				t.Fatalf("handshake failed: %v, %v", a.err, b.err)
+			}
+			if _, err := a.c.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.c.Read(make([]byte, 16)); err != nil {
+				t.Fatal(err)
+			}
+			if tc.readerFirst {
+				b.c.Close()
+			}
+			if err := a.c.Close(); err != tc.want {
+				t.Errorf("Close returned %v, want %v", err, tc.want)
+			}
+			b.c.Close()
+		})
+	}
+}
+
+func TestAcceptDraining(t *testing.T) {
+	srv := httptest.NewServer(&testServer{slots: make(map[string]chan *websocket.Conn), drain: 1})
+	defer srv.Close()
+	sigserv := srv.URL + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	slotc := make(chan string, 2)
+	resc := make(chan dialResult)
+	go func() {
+		cfg := testConfig("")
+		cfg.RetryDraining = true
+		c, err := Accept(ctx, "password", sigserv, slotc, cfg)
+		resc <- dialResult{c, err}
+	}()
+	var slots []string
+	for len(slots) < 2 {
+		select {
+		case slot := <-slotc:
+			slots = append(slots, slot)
+		case a := <-resc:
+			t.Fatalf("Accept returned before getting a second slot: %v", a.err)
+		}
+	}
+	if slots[0] == slots[1] {
+		t.Errorf("got slot %v twice", slots[0])
+	}
+	b, err := Dial(ctx, slots[1], "password", sigserv, testConfig(""))
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	a := <-resc
+	if a.err != nil {
+		t.Fatalf("could not accept: %v", a.err)
+	}
+	defer b.Close()
+	defer a.c.Close()
+}
+
+// TestAcceptDrainingNoRetry checks that Accept gives up when the signalling
+// server shuts down unless asked to retry, without blocking callers that
+// only read one slot.
+func TestAcceptDrainingNoRetry(t *testing.T) {
+	srv := httptest.NewServer(&testServer{slots: make(map[string]chan *websocket.Conn), drain: 1})
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	slotc := make(chan string)
+	resc := make(chan dialResult)
+	go func() {
+		c, err := Accept(ctx, "password", srv.URL+"/", slotc, testConfig(""))
+		resc <- dialResult{c, err}
+	}()
+	<-slotc
+	a := <-resc
+	if closeStatus(a.err) != CloseServerDraining {
+		t.Fatalf("got %v, want the server's draining status", a.err)
+	}
+}
+
+// TestNewContextDraining checks that NewContext gets a new slot when the
+// signalling server shuts down, and goes on to wait for a peer there even
+// though the caller only reads the first slot.
+func TestNewContextDraining(t *testing.T) {
+	ts := &testServer{slots: make(map[string]chan *websocket.Conn), drain: 1}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	slotc := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewContext(ctx, "password", srv.URL+"/", slotc)
+		errc <- err
+	}()
+	<-slotc
+	for booked := 0; booked < 2; {
+		select {
+		case err := <-errc:
+			t.Fatalf("NewContext returned before booking a second slot: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		ts.mu.Lock()
+		booked = ts.next
+		ts.mu.Unlock()
+	}
+	// It is past writing the second slot if it reads what a peer joining
+	// it sends, which is no handshake message, so it fails.
+	peer, err := DialWebSocket(ctx, srv.URL+"/", "2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close(closeNormal, "")
+	if err := peer.Send(ctx, []byte("not a handshake message")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil || ctx.Err() != nil {
+		t.Errorf("got %v, want a handshake error", err)
+	}
+}
+
+// TestCancel checks that cancelling the context of a handshake waiting on a
+// peer that never answers stops it with the context's error.
+func TestCancel(t *testing.T) {
+	sigserv := newTestServer(t)
+	// A peer that books a slot and never answers whoever joins it.
+	silent, err := DialWebSocket(context.Background(), sigserv, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close(closeNormal, "")
+	slot, _ := silent.Slot()
+
+	for _, tc := range []struct {
+		name string
+		dial func(ctx context.Context) (*Wormhole, error)
+	}{
+		{"NewContext", func(ctx context.Context) (*Wormhole, error) {
+			return NewContext(ctx, "password", sigserv, nil)
+		}},
+		{"JoinContext", func(ctx context.Context) (*Wormhole, error) {
+			return JoinContext(ctx, slot, "password", sigserv)
+		}},
+		{"AcceptSignaller", func(ctx context.Context) (*Wormhole, error) {
+			sig, _ := Pipe("pipe")
+			return AcceptSignaller(ctx, "password", sig, nil, testConfig(""))
+		}},
+		{"DialSignaller", func(ctx context.Context) (*Wormhole, error) {
+			_, sig := Pipe("pipe")
+			return DialSignaller(ctx, "password", sig, testConfig(""))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			resc := make(chan dialResult, 1)
+			go func() {
+				c, err := tc.dial(ctx)
+				resc <- dialResult{c, err}
+			}()
+			select {
+			case r := <-resc:
+				t.Fatalf("handshake returned before it was cancelled: %v", r.err)
+			case <-time.After(500 * time.Millisecond):
+			}
+			cancel()
+			select {
+			case r := <-resc:
+				if r.err != context.Canceled {
+					t.Errorf("got %v want %v", r.err, context.Canceled)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("handshake did not stop after it was cancelled")
+			}
+		})
+	}
+}
+
+func TestHandshakeBadKey(t *testing.T) {
+	sigserv := newTestServer(t)
+	for _, versions := range [][2]string{{"5", "5"}, {"5", "4"}, {"4", "5"}} {
+		t.Run(versions[0]+"-"+versions[1], func(t *testing.T) {
+			a, b := handshake(t, sigserv, "password", versions[0], "wrong", versions[1])
+			if a.err != ErrBadKey {
+				t.Errorf("creator got %v want %v", a.err, ErrBadKey)
+			}
+			if b.err != ErrBadKey {
+				t.Errorf("joiner got %v want %v", b.err, ErrBadKey)
+			}
+		})
+	}
+}
+
+func TestHandshakePipe(t *testing.T) {
+	for _, trickle := range []bool{true, false} {
+		t.Run(fmt.Sprintf("trickle=%v", trickle), func(t *testing.T) {
+			testHandshakePipe(t, trickle)
+		})
+	}
+}
+
+// pipeHandshake connects two peers configured by cfg over a Pipe. They are
+// closed when the test finishes.
+func pipeHandshake(t *testing.T, cfg *Config) (a, b *Wormhole) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sigA, sigB := Pipe("pipe")
+	resc := make(chan dialResult)
+	go func() {
+		c, err := AcceptSignaller(ctx, "password", sigA, nil, cfg)
+		resc <- dialResult{c, err}
+	}()
+	b, err := DialSignaller(ctx, "password", sigB, cfg)
+	if err != nil {
+		t.Fatalf("joiner failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	r := <-resc
+	if r.err != nil {
+		t.Fatalf("creator failed: %v", r.err)
+	}
+	t.Cleanup(func() { r.c.Close() })
+	return r.c, b
+}
+
+func testHandshakePipe(t *testing.T, trickle bool) {
+	cfg := testConfig("")
+	cfg.NoTrickle = !trickle
+	a, b := pipeHandshake(t, cfg)
+	if !a.confirmed || !b.confirmed {
+		t.Errorf("key not confirmed")
+	}
+	// Test connections only gather loopback host candidates.
+	for _, c := range []*Wormhole{a, b} {
+		local, remote := c.CandidateTypes()
+		if local != "host" || remote != "host" {
+			t.Errorf("got candidate types %q and %q, want host", local, remote)
+		}
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	// The peers are closed with unread data, so don't wait long for it.
+	d := flushTimeout
+	t.Cleanup(func() { flushTimeout = d })
+	flushTimeout = 500 * time.Millisecond
+	a, _ := pipeHandshake(t, testConfig(""))
+
+	t.Run("read", func(t *testing.T) {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := a.Read(make([]byte, 16))
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			t.Fatalf("read returned with nothing to read: %v", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+		// The deadline unblocks the pending Read.
+		if err := a.SetReadDeadline(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-errc:
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("got %v want %v", err, os.ErrDeadlineExceeded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("read deadline did not unblock read")
+		}
+		a.SetReadDeadline(time.Time{})
+	})
+
+	t.Run("write", func(t *testing.T) {
+		// The peer reads nothing, so writes eventually block waiting for
+		// the buffers to drain, until the deadline passes.
+		if err := a.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			buf := make([]byte, 32<<10)
+			for {
+				if _, err := a.Write(buf); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}()
+		select {
+		case err := <-errc:
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("got %v want %v", err, os.ErrDeadlineExceeded)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("write deadline did not unblock write")
+		}
+	})
+}
+
+func TestStreams(t *testing.T) {
+	a, b := pipeHandshake(t, testConfig(""))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type stream struct {
+		label string
+		opts  *StreamOptions
+		// local is opened by a and remote accepted by b.
+		local, remote *Stream
+	}
+	streams := []*stream{
+		{label: "ordered"},
+		{label: "unordered", opts: &StreamOptions{Unordered: true, Protocol: "test"}},
+	}
+	for _, s := range streams {
+		var err error
+		s.local, err = a.OpenStream(ctx, s.label, s.opts)
+		if err != nil {
+			t.Fatalf("could not open %v: %v", s.label, err)
+		}
+		s.remote, err = b.AcceptStream(ctx)
+		if err != nil {
+			t.Fatalf("could not accept %v: %v", s.label, err)
+		}
+		if got := s.remote.Label(); got != s.label {
+			t.Errorf("accepted stream %q want %q", got, s.label)
+		}
+		ordered := s.opts == nil || !s.opts.Unordered
+		if got := s.remote.d.Ordered(); got != ordered {
+			t.Errorf("%v: got ordered %v want %v", s.label, got, ordered)
+		}
+		protocol := ""
+		if s.opts != nil {
+			protocol = s.opts.Protocol
+		}
+		if got := s.remote.d.Protocol(); got != protocol {
+			t.Errorf("%v: got protocol %q want %q", s.label, got, protocol)
+		}
+	}
+
+	// Send messages both ways on every stream, and on the default one, all
+	// at the same time.
+	const n = 10
+	var wg sync.WaitGroup
+	// Each of the six exchanges below fails at most once on each end.
+	errc := make(chan error, 12)
+	exchange := func(label string, from, to io.ReadWriter) {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if _, err := fmt.Fprintf(from, "%v %v", label, i); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			got := make(map[string]bool)
+			buf := make([]byte, 64)
+			for i := 0; i < n; i++ {
+				m, err := to.Read(buf)
+				if err != nil {
+					errc <- err
+					return
+				}
+				got[string(buf[:m])] = true
+			}
+			// Unordered streams may deliver messages in any order.
+			for i := 0; i < n; i++ {
+				if msg := fmt.Sprintf("%v %v", label, i); !got[msg] {
+					errc <- fmt.Errorf("%v: never got %q", label, msg)
+					return
+				}
+			}
+		}()
+	}
+	for _, s := range streams {
+		exchange(s.label+" a to b", s.local, s.remote)
+		exchange(s.label+" b to a", s.remote, s.local)
+	}
+	exchange("data a to b", a, b)
+	exchange("data b to a", b, a)
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	ctx := context.Background()
+	a, b := Pipe("")
+	if err := a.Send(ctx, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	a.Close(CloseBadKey, "bad key")
+
+	msg, err := b.Receive(ctx)
+	if err != nil || string(msg) != "hello" {
+		t.Errorf("got %q, %v want %q", msg, err, "hello")
+	}
+	_, err = b.Receive(ctx)
+	if closeStatus(err) != CloseBadKey {
+		t.Errorf("got %v want status %v", err, CloseBadKey)
+	}
+	if err := b.Send(ctx, []byte("hello")); closeStatus(err) != CloseBadKey {
+		t.Errorf("send after close got %v want status %v", err, CloseBadKey)
+	}
+}
+
+func TestReadEncJSON(t *testing.T) {
+	ctx := context.Background()
+	key := &[32]byte{1}
+	a, b := Pipe("")
+	if err := writeEncJSON(ctx, a, key, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if err := readEncJSON(ctx, b, key, &got); err != nil || got != "hello" {
+		t.Errorf("got %q, %v want %q", got, err, "hello")
+	}
+	for _, msg := range []string{"", "c2hvcnQ=", base64.URLEncoding.EncodeToString(make([]byte, 24))} {
+		if err := a.Send(ctx, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if err := readEncJSON(ctx, b, key, &got); err == nil {
+			t.Errorf("read %q without error", msg)
+		}
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	const sdp = "v=0\r\n" +
+		"a=fingerprint:sha-256 AB:CD:EF\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n"
+	mk := []byte("pake secret")
+	kc, err := newConfirmation(mk, "5", "1", []byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := kc.mac("offer", sdp)
+
+	if err := kc.verify(mac, "offer", sdp); err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+	if err := kc.verify(mac, "answer", sdp); err != ErrBadKey {
+		t.Errorf("verify with wrong role got %v want %v", err, ErrBadKey)
+	}
+	other := strings.Replace(sdp, "AB:CD:EF", "AB:CD:00", 1)
+	if err := kc.verify(mac, "offer", other); err != ErrBadKey {
+		t.Errorf("verify with wrong fingerprint got %v want %v", err, ErrBadKey)
+	}
+	for _, bad := range [][]string{
+		{"4", "1", "a", "b"},
+		{"5", "2", "a", "b"},
+		{"5", "1", "b", "a"},
+	} {
+		kc, err := newConfirmation(mk, bad[0], bad[1], []byte(bad[2]), []byte(bad[3]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kc.verify(mac, "offer", sdp); err != ErrBadKey {
+			t.Errorf("verify with transcript %v got %v want %v", bad, err, ErrBadKey)
+		}
+	}
+}
+
+func TestSDPFingerprints(t *testing.T) {
+	sdp := "v=0\r\n" +
+		"a=fingerprint:SHA-256 ab:cd\r\n" +
+		"a=setup:actpass\r\n" +
+		"a=fingerprint:sha-1 01:02\r\n"
+	got := sdpFingerprints(sdp)
+	want := []sdpFingerprint{{"sha-256", "AB:CD"}, {"sha-1", "01:02"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("fingerprint %d got %v want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// closeNormal is the status a signaller is closed with when the handshake is
+// abandoned without a more specific reason. It's the same as WebSocket's
+// normal closure status.
+const closeNormal = 1000
+
+// A Signaller carries the messages of the signalling handshake between two
+// peers. Messages are opaque to the Signaller. The handshake authenticates
+// and encrypts everything except the PAKE messages, so a Signaller does not
+// need to be trusted.
+//
+// DialWebSocket returns a Signaller using the WebSocket signalling server the
+// ww tool implements, and Pipe returns a pair connected in memory.
+type Signaller interface {
+	// Slot returns the slot the peers rendezvous on, and the ICE servers
+	// the signalling mechanism suggests. Either may be empty.
+	Slot() (slot string, iceServers []webrtc.ICEServer)
+
+	// Send sends a message to the remote peer.
+	Send(ctx context.Context, msg []byte) error
+
+	// Receive blocks until a message from the remote peer arrives. If
+	// signalling ended with a status, from either side, the error is a
+	// *CloseError.
+	Receive(ctx context.Context) ([]byte, error)
+
+	// Close ends signalling, reporting code, one of the Close constants,
+	// as the outcome of the handshake.
+	Close(code int, reason string) error
+}
+
+// A CloseError is returned by a Signaller once signalling has ended, and
+// holds the status it ended with.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("signalling closed with status %d: %s", e.Code, e.Reason)
+}
+
+// closeStatus returns the status of the CloseError in err's chain, or -1 if
+// there isn't one.
+func closeStatus(err error) int {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return -1
+}
+
+// pipeSignaller is one end of a Pipe.
+type pipeSignaller struct {
+	slot string
+	in   <-chan []byte
+	out  chan<- []byte
+
+	// closed is closed once either end is closed, after which err holds
+	// the status it was closed with.
+	closed    chan struct{}
+	closeOnce *sync.Once
+	err       *error
+}
+
+// Pipe returns two Signallers connected to each other in memory, both on
+// slot. It is useful for tests and for running the handshake over a channel
+// the caller already has.
+func Pipe(slot string) (Signaller, Signaller) {
+	ab := make(chan []byte, 16)
+	ba := make(chan []byte, 16)
+	closed := make(chan struct{})
+	var once sync.Once
+	var err error
+	a := &pipeSignaller{slot: slot, in: ba, out: ab, closed: closed, closeOnce: &once, err: &err}
+	b := &pipeSignaller{slot: slot, in: ab, out: ba, closed: closed, closeOnce: &once, err: &err}
+	return a, b
+}
+
+func (p *pipeSignaller) Slot() (string, []webrtc.ICEServer) {
+	return p.slot, nil
+}
+
+func (p *pipeSignaller) Send(ctx context.Context, msg []byte) error {
+	select {
+	case <-p.closed:
+		return *p.err
+	default:
+	}
+	select {
+	case p.out <- append([]byte(nil), msg...):
+		return nil
+	case <-p.closed:
+		return *p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *pipeSignaller) Receive(ctx context.Context) ([]byte, error) {
+	// Deliver messages sent before the pipe was closed first.
+	select {
+	case msg := <-p.in:
+		return msg, nil
+	default:
+	}
+	select {
+	case msg := <-p.in:
+		return msg, nil
+	case <-p.closed:
+		return nil, *p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *pipeSignaller) Close(code int, reason string) error {
+	err := net.ErrClosed
+	p.closeOnce.Do(func() {
+		*p.err = &CloseError{Code: code, Reason: reason}
+		close(p.closed)
+		err = nil
+	})
+	return err
+}
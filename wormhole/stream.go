@@ -0,0 +1,282 @@
+package wormhole
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	webrtc "github.com/pion/webrtc/v3"
+)
+
+// A Stream is a DataChannel on a wormhole's PeerConnection. Every wormhole
+// has a default stream which its Read and Write methods use. More streams
+// can be opened using OpenStream and AcceptStream.
+type Stream struct {
+	rwc io.ReadWriteCloser
+	d   *webrtc.DataChannel
+	cfg *Config
+
+	// opened signals that the underlying DataChannel is open and ready
+	// to handle data.
+	opened chan struct{}
+	// err forwards errors from the OnError callback.
+	err chan error
+	// flushc is a condition variable to coordinate flushed state of the
+	// underlying channel.
+	flushc *sync.Cond
+
+	// writeDeadline and writeTimer implement SetWriteDeadline. They are
+	// protected by flushc.L.
+	writeDeadline time.Time
+	writeTimer    *time.Timer
+}
+
+// StreamOptions configures a stream opened with OpenStream. A nil
+// *StreamOptions opens an ordered and reliable stream.
+type StreamOptions struct {
+	// Unordered allows messages to be delivered out of order.
+	Unordered bool
+
+	// MaxRetransmits, if not nil, makes the stream unreliable and limits
+	// the number of times a message is retransmitted.
+	MaxRetransmits *uint16
+
+	// MaxPacketLifeTime, if not nil, makes the stream unreliable and limits
+	// the time in milliseconds during which a message is retransmitted.
+	MaxPacketLifeTime *uint16
+
+	// Protocol is the name of the sub-protocol used on the stream.
+	Protocol string
+}
+
+func (opts *StreamOptions) init() *webrtc.DataChannelInit {
+	if opts == nil {
+		return nil
+	}
+	ordered := !opts.Unordered
+	return &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxRetransmits:    opts.MaxRetransmits,
+		MaxPacketLifeTime: opts.MaxPacketLifeTime,
+		Protocol:          &opts.Protocol,
+	}
+}
+
+func newStream(d *webrtc.DataChannel, cfg *Config) *Stream {
+	s := &Stream{
+		d:      d,
+		cfg:    cfg,
+		opened: make(chan struct{}),
+		err:    make(chan error, 1),
+		flushc: sync.NewCond(&sync.Mutex{}),
+	}
+	d.OnOpen(s.open)
+	d.OnError(s.error)
+	d.OnBufferedAmountLow(s.flushed)
+	d.SetBufferedAmountLowThreshold(cfg.lowThreshold())
+	return s
+}
+
+// Label returns the label of the stream's DataChannel.
+func (s *Stream) Label() string {
+	return s.d.Label()
+}
+
+// Write writes a message to the stream.
+func (s *Stream) Write(p []byte) (n int, err error) {
+	// The webrtc package's channel does not have a blocking Write, so
+	// we can't just use io.Copy until the issue is fixed upsteam.
+	// Work around this by blocking here and waiting for flushes.
+	// https://github.com/pion/sctp/issues/77
+	s.flushc.L.Lock()
+	for {
+		if s.writeTimedOut() {
+			s.flushc.L.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if s.d.BufferedAmount() <= s.cfg.highThreshold() {
+			break
+		}
+		s.flushc.Wait()
+	}
+	s.flushc.L.Unlock()
+	return s.rwc.Write(p)
+}
+
+// Read reads a message from the stream.
+func (s *Stream) Read(p []byte) (n int, err error) {
+	return s.rwc.Read(p)
+}
+
+// TODO benchmark this buffer madness.
+func (s *Stream) flushed() {
+	s.flushc.L.Lock()
+	s.flushc.Signal()
+	s.flushc.L.Unlock()
+}
+
+// flushTimeout is how long Close waits for the stream's buffers to drain
+// while none of their data is getting through, as when the peer has gone
+// away without acknowledging it.
+var flushTimeout = 5 * time.Second
+
+// Close attempts to flush the stream's buffers then closes it. If the peer
+// stops acknowledging what is in them, it gives up and returns
+// ErrNotFlushed.
+func (s *Stream) Close() error {
+	err := s.flush()
+	for _, c := range []io.Closer{s.rwc, s.d} {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// flush waits for the stream's buffers to drain, or for flushTimeout to pass
+// without any progress.
+func (s *Stream) flush() error {
+	buffered, progress := s.d.BufferedAmount(), time.Now()
+	for buffered != 0 {
+		if time.Since(progress) >= flushTimeout {
+			s.cfg.logf("giving up flushing %v bytes", buffered)
+			return ErrNotFlushed
+		}
+		// SetBufferedAmountLowThreshold does not seem to take effect
+		// when after the last Write().
+		time.Sleep(100 * time.Millisecond) // eww.
+		if n := s.d.BufferedAmount(); n != buffered {
+			buffered, progress = n, time.Now()
+		}
+	}
+	return nil
+}
+
+func (s *Stream) open() {
+	var err error
+	s.rwc, err = s.d.Detach()
+	if err != nil {
+		s.error(err)
+		return
+	}
+	close(s.opened)
+}
+
+// It's not really clear to me when this will be invoked.
+func (s *Stream) error(err error) {
+	s.cfg.logf("debug: %v", err)
+	select {
+	case s.err <- err:
+	default:
+	}
+}
+
+// wait blocks until the stream is open, fails, or ctx is done.
+func (s *Stream) wait(ctx context.Context) error {
+	select {
+	case <-s.opened:
+		return nil
+	case err := <-s.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (s *Stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+// A zero t means Read will not time out.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	d, ok := s.rwc.(readDeadliner)
+	if !ok {
+		return os.ErrNoDeadline
+	}
+	return d.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for pending and future Write calls,
+// including those waiting for the DataChannel's buffers to drain.
+// A zero t means Write will not time out.
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.flushc.L.Lock()
+	defer s.flushc.L.Unlock()
+	s.writeDeadline = t
+	if s.writeTimer != nil {
+		s.writeTimer.Stop()
+		s.writeTimer = nil
+	}
+	if !t.IsZero() {
+		// Wake up any blocked writers when the deadline passes.
+		s.writeTimer = time.AfterFunc(time.Until(t), func() {
+			s.flushc.L.Lock()
+			s.flushc.Broadcast()
+			s.flushc.L.Unlock()
+		})
+	}
+	return nil
+}
+
+// writeTimedOut reports whether the write deadline has passed. It must be
+// called with s.flushc.L held.
+func (s *Stream) writeTimedOut() bool {
+	return !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline)
+}
+
+// OpenStream opens a new stream with label and opts and waits for it to be
+// ready. The remote peer receives it from AcceptStream.
+func (c *Wormhole) OpenStream(ctx context.Context, label string, opts *StreamOptions) (*Stream, error) {
+	d, err := c.pc.CreateDataChannel(label, opts.init())
+	if err != nil {
+		return nil, err
+	}
+	s := newStream(d, &c.cfg)
+	err = s.wait(ctx)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for the remote peer to open a stream and returns it.
+func (c *Wormhole) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case s := <-c.accept:
+		return s, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleDataChannel queues DataChannels opened by the remote peer for
+// AcceptStream.
+func (c *Wormhole) handleDataChannel(d *webrtc.DataChannel) {
+	c.cfg.logf("remote opened stream: %v", d.Label())
+	s := newStream(d, &c.cfg)
+	go func() {
+		select {
+		case <-s.opened:
+		case <-s.err:
+			return
+		case <-c.closed:
+			return
+		}
+		select {
+		case c.accept <- s:
+		case <-c.closed:
+			s.Close()
+		}
+	}()
+}
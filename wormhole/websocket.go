@@ -0,0 +1,114 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	webrtc "github.com/pion/webrtc/v3"
+	"nhooyr.io/websocket"
+)
+
+// wsSignaller is a Signaller using a WebSocket signalling server.
+type wsSignaller struct {
+	ws         *websocket.Conn
+	slot       string
+	iceServers []webrtc.ICEServer
+}
+
+// DialWebSocket connects to the WebSocket signalling server sigserv. If slot
+// is empty the server allocates a new one, which the Signaller's Slot
+// method returns. Otherwise it joins slot.
+//
+// A nil cfg uses the defaults.
+func DialWebSocket(ctx context.Context, sigserv, slot string, cfg *Config) (Signaller, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	u, err := url.Parse(sigserv)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" || u.Scheme == "ws" {
+		u.Scheme = "ws"
+	} else {
+		u.Scheme = "wss"
+	}
+	u.Path += slot
+	wsaddr := u.String()
+
+	ws, _, err := websocket.Dial(ctx, wsaddr, &websocket.DialOptions{
+		Subprotocols: cfg.protocols(),
+		HTTPClient:   cfg.HTTPClient,
+		HTTPHeader:   cfg.HTTPHeader,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &wsSignaller{ws: ws, slot: slot}
+	assignedSlot, err := s.readInitMsg(ctx)
+	if closeStatus(err) == CloseWrongProto {
+		return nil, ErrBadVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.slot == "" {
+		s.slot = assignedSlot
+	}
+	return s, nil
+}
+
+// NewWebSocketSignaller returns a Signaller that exchanges messages with the
+// remote peer directly over ws, on slot. It is for serving a peer without a
+// signalling server in between, like on a local network, and assumes the
+// peer was already sent the initial message a signalling server would send.
+func NewWebSocketSignaller(ws *websocket.Conn, slot string, iceServers []webrtc.ICEServer) Signaller {
+	return &wsSignaller{ws: ws, slot: slot, iceServers: iceServers}
+}
+
+// readInitMsg reads the first message the signalling server sends over
+// the WebSocket connection, which has metadata includign assigned slot
+// and ICE servers to use.
+func (s *wsSignaller) readInitMsg(ctx context.Context) (slot string, err error) {
+	msg := struct {
+		Slot       string             `json:"slot",omitempty`
+		ICEServers []webrtc.ICEServer `json:"iceServers",omitempty`
+	}{}
+
+	buf, err := s.Receive(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal(buf, &msg)
+	s.iceServers = msg.ICEServers
+	return msg.Slot, err
+}
+
+func (s *wsSignaller) Slot() (string, []webrtc.ICEServer) {
+	return s.slot, s.iceServers
+}
+
+func (s *wsSignaller) Send(ctx context.Context, msg []byte) error {
+	return wsError(s.ws.Write(ctx, websocket.MessageText, msg))
+}
+
+func (s *wsSignaller) Receive(ctx context.Context) ([]byte, error) {
+	_, buf, err := s.ws.Read(ctx)
+	return buf, wsError(err)
+}
+
+func (s *wsSignaller) Close(code int, reason string) error {
+	return wsError(s.ws.Close(websocket.StatusCode(code), reason))
+}
+
+// wsError converts WebSocket close errors to *CloseError.
+func wsError(err error) error {
+	var ce websocket.CloseError
+	if errors.As(err, &ce) {
+		return &CloseError{Code: int(ce.Code), Reason: ce.Reason}
+	}
+	return err
+}